@@ -0,0 +1,322 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	BreakerState       = "breaker.state"
+	BreakerStateChange = "breaker.state_change"
+	BreakerRejected    = "breaker.rejected"
+)
+
+// ErrCircuitOpen is returned when a call is rejected because the circuit is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// State is the state of a circuit breaker
+type State int
+
+// Possible states
+// Values are ordered by severity to make the state gauge readable
+const (
+	// Closed lets all the calls go through
+	Closed State = iota
+	// HalfOpen lets a limited number of probe calls go through to check if the service recovered
+	HalfOpen
+	// Open rejects all the calls until the cool-down period is over
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half_open"
+	case Open:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// Counts holds the numbers of calls made in the rolling window
+type Counts struct {
+	Requests            int
+	Successes           int
+	Failures            int
+	ConsecutiveFailures int
+}
+
+// TripFunc decides if the circuit must open after a failure
+type TripFunc func(c Counts) bool
+
+// ConsecutiveFailures opens the circuit after n consecutive failures
+func ConsecutiveFailures(n int) TripFunc {
+	return func(c Counts) bool {
+		return c.ConsecutiveFailures >= n
+	}
+}
+
+// FailureRatio opens the circuit when the ratio of failed calls in the window reaches ratio
+// The ratio is not evaluated before minRequests calls have been made in the window
+func FailureRatio(ratio float64, minRequests int) TripFunc {
+	return func(c Counts) bool {
+		if c.Requests == 0 || c.Requests < minRequests {
+			return false
+		}
+		return float64(c.Failures)/float64(c.Requests) >= ratio
+	}
+}
+
+// StateChangeFunc is called every time the circuit changes state
+type StateChangeFunc func(name string, from, to State)
+
+// Breaker is a circuit breaker protecting calls to an unhealthy service
+type Breaker interface {
+	// Allow checks if a call can be made. If so, done must be called with the call error (nil on success)
+	// It returns ErrCircuitOpen otherwise
+	Allow() (done func(err error), err error)
+	// Execute calls fn if the circuit allows it and records its result
+	Execute(fn func() error) error
+	// State returns the current state
+	State() State
+}
+
+// Option customizes the default Breaker implementation
+type Option func(b *breaker)
+
+// Trip sets the condition opening the circuit. Default is 5 consecutive failures
+func Trip(f TripFunc) Option {
+	return func(b *breaker) {
+		b.trip = f
+	}
+}
+
+// Window sets the rolling window used to count the calls, split into the given number of buckets
+// Default is 1 minute split into 6 buckets
+func Window(d time.Duration, buckets int) Option {
+	return func(b *breaker) {
+		b.window = newWindow(d, buckets)
+	}
+}
+
+// Cooldown sets the time spent in the open state before probing the service again. Default is 30 seconds
+// It is also the time after which half-open probes that never reported their result are considered lost
+func Cooldown(d time.Duration) Option {
+	return func(b *breaker) {
+		b.cooldown = d
+	}
+}
+
+// HalfOpenRequests sets the number of successful probe calls needed to close the circuit
+// It is also the maximum number of concurrent calls in the half-open state. Default is 1
+func HalfOpenRequests(n int) Option {
+	return func(b *breaker) {
+		b.halfOpenRequests = n
+	}
+}
+
+// OnStateChange registers a callback called on every state change
+// Callbacks are called synchronously while the breaker is locked so they must not call it
+func OnStateChange(f StateChangeFunc) Option {
+	return func(b *breaker) {
+		b.onStateChange = append(b.onStateChange, f)
+	}
+}
+
+// WithMetrics sends the state of the circuit as a gauge, and counts state changes and rejected calls
+func WithMetrics(client metrics.Client) Option {
+	return func(b *breaker) {
+		b.metrics = client
+	}
+}
+
+// WithClock sets the clock used to measure the window and the cool-down period. Use a fake clock in tests
+func WithClock(c clock.Clock) Option {
+	return func(b *breaker) {
+		b.clock = c
+	}
+}
+
+// New creates a default Breaker implementation
+// name identifies the breaker in callbacks and metrics
+func New(name string, options ...Option) Breaker {
+	b := &breaker{
+		name:             name,
+		trip:             ConsecutiveFailures(5),
+		window:           newWindow(time.Minute, 6),
+		cooldown:         30 * time.Second,
+		halfOpenRequests: 1,
+		metrics:          metrics.Default,
+		clock:            clock.New(),
+	}
+
+	for _, option := range options {
+		option(b)
+	}
+
+	b.metrics = b.metrics.WithTag("breaker:" + name)
+
+	return b
+}
+
+type breaker struct {
+	name             string
+	trip             TripFunc
+	window           *window
+	cooldown         time.Duration
+	halfOpenRequests int
+	onStateChange    []StateChangeFunc
+	metrics          metrics.Client
+	clock            clock.Clock
+
+	mutex    sync.Mutex
+	state    State
+	openedAt time.Time
+	// generation changes with every state change so that results of calls started
+	// in a previous state are ignored
+	generation uint64
+	// probes and probeSuccesses count the calls made in the half-open state
+	probes         int
+	probeSuccesses int
+	probedAt       time.Time
+}
+
+func (b *breaker) State() State {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.currentState(b.clock.Now())
+}
+
+func (b *breaker) Allow() (func(err error), error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	state := b.currentState(now)
+	b.metrics.Gauge(BreakerState, float64(state))
+
+	switch state {
+	case Open:
+		b.metrics.Incr(BreakerRejected)
+		return nil, ErrCircuitOpen
+	case HalfOpen:
+		if b.probes >= b.halfOpenRequests && now.Sub(b.probedAt) >= b.cooldown {
+			// the pending probes never called done, their slots are freed
+			b.probes = b.probeSuccesses
+		}
+		if b.probes >= b.halfOpenRequests {
+			b.metrics.Incr(BreakerRejected)
+			return nil, ErrCircuitOpen
+		}
+		b.probes++
+		b.probedAt = now
+	}
+
+	generation := b.generation
+	var once sync.Once
+
+	return func(err error) {
+		once.Do(func() {
+			b.record(generation, err)
+		})
+	}, nil
+}
+
+func (b *breaker) Execute(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+
+	defer recordPanic(done)
+
+	err = fn()
+	done(err)
+	return err
+}
+
+// errPanic is recorded by the breaker when a call panics
+var errPanic = errors.New("panic")
+
+// recordPanic records a failure if the call panics, then panics again
+// It must be deferred
+func recordPanic(done func(err error)) {
+	if p := recover(); p != nil {
+		done(errPanic)
+		panic(p)
+	}
+}
+
+// currentState returns the state at the passed time, moving from open to half-open
+// when the cool-down period is over. Must be called with the mutex locked
+func (b *breaker) currentState(now time.Time) State {
+	if b.state == Open && now.Sub(b.openedAt) >= b.cooldown {
+		b.setState(HalfOpen, now)
+	}
+	return b.state
+}
+
+// record records the result of a call. Must be called with the mutex unlocked
+func (b *breaker) record(generation uint64, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	state := b.currentState(now)
+	if generation != b.generation {
+		// the call started in a previous state, the result is not relevant anymore
+		return
+	}
+
+	switch state {
+	case Closed:
+		b.window.add(now, err == nil)
+		if err != nil && b.trip(b.window.counts(now)) {
+			b.setState(Open, now)
+		}
+	case HalfOpen:
+		if err != nil {
+			b.setState(Open, now)
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.halfOpenRequests {
+			b.setState(Closed, now)
+		}
+	}
+}
+
+// setState changes the state. Must be called with the mutex locked
+func (b *breaker) setState(state State, now time.Time) {
+	if b.state == state {
+		return
+	}
+
+	from := b.state
+	b.state = state
+	b.generation++
+	b.probes, b.probeSuccesses = 0, 0
+
+	switch state {
+	case Open:
+		b.openedAt = now
+	case Closed:
+		b.window.reset()
+	}
+
+	b.metrics.Gauge(BreakerState, float64(state))
+	b.metrics.WithTags([]string{"from:" + from.String(), "to:" + state.String()}).Incr(BreakerStateChange)
+
+	for _, f := range b.onStateChange {
+		f(b.name, from, state)
+	}
+}
@@ -0,0 +1,166 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+var errFailure = errors.New("failure")
+
+// newTestBreaker returns a breaker with a manually controlled clock
+func newTestBreaker(options ...Option) (Breaker, *clock.Fake) {
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	return New("test", append(options, WithClock(c))...), c
+}
+
+func TestItOpensAfterConsecutiveFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	b, _ := newTestBreaker(Trip(ConsecutiveFailures(3)))
+
+	assert.Equal(errFailure, b.Execute(func() error { return errFailure }))
+	assert.Equal(errFailure, b.Execute(func() error { return errFailure }))
+	assert.Nil(b.Execute(func() error { return nil }))
+	assert.Equal(errFailure, b.Execute(func() error { return errFailure }))
+	assert.Equal(errFailure, b.Execute(func() error { return errFailure }))
+	assert.Equal(Closed, b.State())
+
+	assert.Equal(errFailure, b.Execute(func() error { return errFailure }))
+	assert.Equal(Open, b.State())
+
+	called := false
+	err := b.Execute(func() error {
+		called = true
+		return nil
+	})
+	assert.False(called)
+	assert.Equal(ErrCircuitOpen, err)
+}
+
+func TestItOpensWhenFailureRatioIsReached(t *testing.T) {
+	assert := assert.New(t)
+
+	b, c := newTestBreaker(Trip(FailureRatio(0.5, 4)), Window(time.Minute, 6))
+
+	// not enough requests
+	b.Execute(func() error { return errFailure })
+	b.Execute(func() error { return errFailure })
+	assert.Equal(Closed, b.State())
+
+	// these calls go out of the window
+	c.Advance(2 * time.Minute)
+	b.Execute(func() error { return nil })
+	b.Execute(func() error { return nil })
+	b.Execute(func() error { return errFailure })
+	assert.Equal(Closed, b.State())
+
+	b.Execute(func() error { return errFailure })
+	assert.Equal(Open, b.State())
+}
+
+func TestItProbesTheServiceAfterCooldown(t *testing.T) {
+	assert := assert.New(t)
+
+	var changes []string
+	b, c := newTestBreaker(
+		Trip(ConsecutiveFailures(1)),
+		Cooldown(10*time.Second),
+		HalfOpenRequests(2),
+		OnStateChange(func(name string, from, to State) {
+			changes = append(changes, name+":"+from.String()+"->"+to.String())
+		}),
+	)
+
+	b.Execute(func() error { return errFailure })
+	assert.Equal(Open, b.State())
+
+	c.Advance(10 * time.Second)
+	assert.Equal(HalfOpen, b.State())
+
+	// only 2 concurrent probes
+	done1, err := b.Allow()
+	assert.Nil(err)
+	done2, err := b.Allow()
+	assert.Nil(err)
+	_, err = b.Allow()
+	assert.Equal(ErrCircuitOpen, err)
+
+	done1(nil)
+	assert.Equal(HalfOpen, b.State())
+	done2(nil)
+	assert.Equal(Closed, b.State())
+
+	// a failed probe opens the circuit again
+	b.Execute(func() error { return errFailure })
+	c.Advance(10 * time.Second)
+	b.Execute(func() error { return errFailure })
+	assert.Equal(Open, b.State())
+
+	assert.Equal([]string{
+		"test:closed->open",
+		"test:open->half_open",
+		"test:half_open->closed",
+		"test:closed->open",
+		"test:open->half_open",
+		"test:half_open->open",
+	}, changes)
+}
+
+func TestItRecordsPanicsAsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	b, c := newTestBreaker(Trip(ConsecutiveFailures(1)), Cooldown(10*time.Second))
+
+	assert.Panics(func() {
+		b.Execute(func() error { panic("oops") })
+	})
+	assert.Equal(Open, b.State())
+
+	// a panicking probe does not keep the half-open slot
+	c.Advance(10 * time.Second)
+	assert.Panics(func() {
+		b.Execute(func() error { panic("oops") })
+	})
+	assert.Equal(Open, b.State())
+	c.Advance(10 * time.Second)
+	assert.Nil(b.Execute(func() error { return nil }))
+	assert.Equal(Closed, b.State())
+}
+
+func TestItFreesProbesThatNeverReport(t *testing.T) {
+	assert := assert.New(t)
+
+	b, c := newTestBreaker(Trip(ConsecutiveFailures(1)), Cooldown(10*time.Second))
+
+	b.Execute(func() error { return errFailure })
+	c.Advance(10 * time.Second)
+
+	// the probe never calls done
+	_, err := b.Allow()
+	assert.Nil(err)
+	_, err = b.Allow()
+	assert.Equal(ErrCircuitOpen, err)
+
+	// it is considered lost after the cool-down period
+	c.Advance(10 * time.Second)
+	assert.Nil(b.Execute(func() error { return nil }))
+	assert.Equal(Closed, b.State())
+}
+
+func TestItIgnoresResultsFromPreviousStates(t *testing.T) {
+	assert := assert.New(t)
+
+	b, _ := newTestBreaker(Trip(ConsecutiveFailures(1)))
+
+	done, _ := b.Allow()
+	b.Execute(func() error { return errFailure })
+	assert.Equal(Open, b.State())
+
+	// a late success does not close the circuit
+	done(nil)
+	assert.Equal(Open, b.State())
+}
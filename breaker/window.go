@@ -0,0 +1,90 @@
+package breaker
+
+import (
+	"time"
+)
+
+// window counts calls over a rolling period split into buckets
+// The oldest bucket is dropped every time a new bucket starts
+// It is not safe for concurrent use
+type window struct {
+	buckets    []bucket
+	bucketSize time.Duration
+	// current is the index of the current bucket and start its start time
+	current int
+	start   time.Time
+	// consecutiveFailures is not limited to the window
+	consecutiveFailures int
+}
+
+type bucket struct {
+	successes int
+	failures  int
+}
+
+func newWindow(d time.Duration, buckets int) *window {
+	if buckets < 1 {
+		buckets = 1
+	}
+	return &window{
+		buckets:    make([]bucket, buckets),
+		bucketSize: d / time.Duration(buckets),
+	}
+}
+
+func (w *window) add(now time.Time, success bool) {
+	w.advance(now)
+
+	if success {
+		w.buckets[w.current].successes++
+		w.consecutiveFailures = 0
+		return
+	}
+
+	w.buckets[w.current].failures++
+	w.consecutiveFailures++
+}
+
+func (w *window) counts(now time.Time) Counts {
+	w.advance(now)
+
+	c := Counts{
+		ConsecutiveFailures: w.consecutiveFailures,
+	}
+	for _, b := range w.buckets {
+		c.Successes += b.successes
+		c.Failures += b.failures
+	}
+	c.Requests = c.Successes + c.Failures
+	return c
+}
+
+func (w *window) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = bucket{}
+	}
+	w.start = time.Time{}
+	w.consecutiveFailures = 0
+}
+
+// advance moves the current bucket forward, clearing the buckets that went out of the window
+func (w *window) advance(now time.Time) {
+	if w.start.IsZero() || w.bucketSize <= 0 {
+		w.start = now
+		return
+	}
+
+	elapsed := int(now.Sub(w.start) / w.bucketSize)
+	if elapsed <= 0 {
+		return
+	}
+
+	if elapsed > len(w.buckets) {
+		elapsed = len(w.buckets)
+	}
+	for i := 0; i < elapsed; i++ {
+		w.current = (w.current + 1) % len(w.buckets)
+		w.buckets[w.current] = bucket{}
+	}
+	w.start = w.start.Add(time.Duration(int(now.Sub(w.start)/w.bucketSize)) * w.bucketSize)
+}
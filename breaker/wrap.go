@@ -0,0 +1,105 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/fchoquet/golibs/retry"
+)
+
+// Doer is the interface implemented by http.Client
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// WrapDoer protects an http client with a circuit breaker
+// Transport errors and 5xx responses are counted as failures
+// The wrapped doer can be passed to retry.SendHTTPRequest
+func WrapDoer(b Breaker, d Doer) Doer {
+	return &doer{
+		breaker: b,
+		doer:    d,
+	}
+}
+
+type doer struct {
+	breaker Breaker
+	doer    Doer
+}
+
+func (d *doer) Do(req *http.Request) (*http.Response, error) {
+	done, err := d.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	defer recordPanic(done)
+
+	res, err := d.doer.Do(req)
+	switch {
+	case err != nil:
+		done(err)
+	case res.StatusCode >= 500:
+		done(errServerError)
+	default:
+		done(nil)
+	}
+
+	return res, err
+}
+
+// errServerError is recorded by the breaker when a 5xx status is returned
+var errServerError = errors.New("server error")
+
+// WrapRetrier protects every attempt of a Retrier with a circuit breaker
+// Retryable errors are counted as failures. Non-retryable errors mean the service
+// could process the call (a validation error for instance) so they are counted as successes
+// When the circuit is open, attempts fail with ErrCircuitOpen and are not retried
+// r is adapted with retry.WithContext if it does not implement retry.ContextRetrier
+func WrapRetrier(b Breaker, r retry.Retrier) retry.ContextRetrier {
+	return &retrier{
+		breaker: b,
+		retrier: retry.WithContext(r),
+	}
+}
+
+type retrier struct {
+	breaker Breaker
+	retrier retry.ContextRetrier
+}
+
+func (r *retrier) Retry(do retry.AttemptFunc) error {
+	return r.retrier.Retry(func(attempt int) (error, bool) {
+		return r.wrap(func(_ context.Context, attempt int) (error, bool) {
+			return do(attempt)
+		})(context.Background(), attempt)
+	})
+}
+
+func (r *retrier) RetryContext(ctx context.Context, do retry.ContextAttemptFunc) error {
+	return r.retrier.RetryContext(ctx, r.wrap(do))
+}
+
+func (r *retrier) RetryWithResult(ctx context.Context, do retry.ContextAttemptFunc) *retry.Result {
+	return r.retrier.RetryWithResult(ctx, r.wrap(do))
+}
+
+// wrap protects a single attempt with the breaker
+func (r *retrier) wrap(do retry.ContextAttemptFunc) retry.ContextAttemptFunc {
+	return func(ctx context.Context, attempt int) (error, bool) {
+		done, err := r.breaker.Allow()
+		if err != nil {
+			return err, false
+		}
+		defer recordPanic(done)
+
+		err, retry := do(ctx, attempt)
+		if err != nil && retry {
+			done(err)
+		} else {
+			done(nil)
+		}
+
+		return err, retry
+	}
+}
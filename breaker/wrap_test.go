@@ -0,0 +1,67 @@
+package breaker
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fchoquet/golibs/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWrapDoer(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 503, Body: ioutil.NopCloser(strings.NewReader("down"))}, nil
+	})
+
+	b := New("test", Trip(ConsecutiveFailures(2)))
+	d := WrapDoer(b, client)
+
+	_, err := retry.SendHTTPRequest(retry.New(5, retry.TestBackoff), d, &http.Request{})
+	assert.NotNil(err)
+
+	// the circuit opened after 2 calls, next attempts failed fast
+	assert.Equal(2, calls)
+	assert.Equal(Open, b.State())
+
+	_, err = d.Do(&http.Request{})
+	assert.Equal(ErrCircuitOpen, err)
+	assert.Equal(2, calls)
+}
+
+func TestWrapRetrier(t *testing.T) {
+	assert := assert.New(t)
+
+	b := New("test", Trip(ConsecutiveFailures(2)))
+	r := WrapRetrier(b, retry.New(5, retry.TestBackoff))
+
+	// non-retryable errors do not count as failures
+	calls := 0
+	r.Retry(func(attempt int) (error, bool) {
+		calls++
+		return errors.New("bad request"), false
+	})
+	assert.Equal(1, calls)
+	assert.Equal(Closed, b.State())
+
+	calls = 0
+	err := r.Retry(func(attempt int) (error, bool) {
+		calls++
+		return errors.New("unavailable"), true
+	})
+	assert.Equal(2, calls)
+	assert.Equal(ErrCircuitOpen, err)
+	assert.Equal(Open, b.State())
+}
@@ -0,0 +1,195 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only changes when Advance is called
+// Timers, tickers and sleepers fire as soon as the time reaches their deadline. It is safe for concurrent use
+type Fake struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// NewFake returns a fake Clock set to now
+func NewFake(now time.Time) *Fake {
+	f := &Fake{
+		now: now,
+	}
+	f.cond = sync.NewCond(&f.mutex)
+	return f
+}
+
+// Advance moves the time forward and fires the timers, tickers and sleepers reaching their deadline
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	target := f.now.Add(d)
+	for len(f.waiters) > 0 && !f.waiters[0].at.After(target) {
+		w := f.waiters[0]
+		f.now = w.at
+		w.fire()
+	}
+	f.now = target
+}
+
+// BlockUntil blocks until at least n timers, tickers or sleepers are waiting
+// It lets tests make sure that the code under test is waiting before calling Advance
+func (f *Fake) BlockUntil(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+// Waiters returns the number of timers, tickers and sleepers waiting
+func (f *Fake) Waiters() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.waiters)
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.now
+}
+
+// Since returns the fake time elapsed since t
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// Sleep blocks until the fake time is advanced by d
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// After waits for the fake time to be advanced by d then sends the fake time on the returned channel
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer creates a timer firing when the fake time is advanced by d
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	w := &fakeWaiter{
+		fake: f,
+		c:    make(chan time.Time, 1),
+	}
+	f.schedule(w, d)
+	return w
+}
+
+// NewTicker creates a ticker firing every time the fake time is advanced by d
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	w := &fakeWaiter{
+		fake:   f,
+		c:      make(chan time.Time, 1),
+		period: d,
+	}
+	f.schedule(w, d)
+	return fakeTicker{w}
+}
+
+// schedule adds a waiter firing in d. Must be called with the mutex locked
+func (f *Fake) schedule(w *fakeWaiter, d time.Duration) {
+	w.at = f.now.Add(d)
+	if d <= 0 {
+		w.send()
+		return
+	}
+
+	f.waiters = append(f.waiters, w)
+	sort.SliceStable(f.waiters, func(i, j int) bool {
+		return f.waiters[i].at.Before(f.waiters[j].at)
+	})
+	f.cond.Broadcast()
+}
+
+// unschedule removes a waiter. It returns false if it was not waiting. Must be called with the mutex locked
+func (f *Fake) unschedule(w *fakeWaiter) bool {
+	for i, waiter := range f.waiters {
+		if waiter == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeWaiter is either a timer or a ticker
+type fakeWaiter struct {
+	fake   *Fake
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) Stop() bool {
+	w.fake.mutex.Lock()
+	defer w.fake.mutex.Unlock()
+
+	return w.fake.unschedule(w)
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	w.fake.mutex.Lock()
+	defer w.fake.mutex.Unlock()
+
+	active := w.fake.unschedule(w)
+	w.fake.schedule(w, d)
+	return active
+}
+
+// fire sends the time and reschedules tickers. Must be called with the mutex locked
+func (w *fakeWaiter) fire() {
+	w.fake.unschedule(w)
+	w.send()
+	if w.period > 0 {
+		w.fake.schedule(w, w.at.Add(w.period).Sub(w.fake.now))
+	}
+}
+
+// send sends the time without blocking. Like the standard library, it is dropped if nobody reads it
+func (w *fakeWaiter) send() {
+	select {
+	case w.c <- w.at:
+	default:
+	}
+}
+
+type fakeTicker struct {
+	w *fakeWaiter
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.w.C()
+}
+
+func (t fakeTicker) Stop() {
+	t.w.Stop()
+}
@@ -0,0 +1,87 @@
+package clock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestFakeNow(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewFake(start)
+	assert.Equal(start, c.Now())
+
+	c.Advance(time.Minute)
+	assert.Equal(start.Add(time.Minute), c.Now())
+	assert.Equal(time.Minute, c.Since(start))
+}
+
+func TestFakeTimer(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewFake(start)
+	timer := c.NewTimer(time.Second)
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Error("timer fired too early")
+	default:
+	}
+
+	c.Advance(time.Millisecond)
+	assert.Equal(start.Add(time.Second), <-timer.C())
+	assert.False(timer.Stop())
+
+	// a reset timer fires again
+	assert.False(timer.Reset(time.Second))
+	assert.True(timer.Stop())
+	c.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewFake(start)
+	ticker := c.NewTicker(time.Second)
+
+	c.Advance(time.Second)
+	assert.Equal(start.Add(time.Second), <-ticker.C())
+
+	// ticks are dropped when nobody reads them
+	c.Advance(3 * time.Second)
+	assert.Equal(start.Add(2*time.Second), <-ticker.C())
+
+	ticker.Stop()
+	c.Advance(time.Second)
+	assert.Equal(0, c.Waiters())
+}
+
+func TestFakeSleep(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewFake(start)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		c.Sleep(time.Hour)
+		wg.Done()
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Hour)
+	wg.Wait()
+
+	assert.Equal(start.Add(time.Hour), c.Now())
+}
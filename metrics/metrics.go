@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/fchoquet/golibs/clock"
 )
 
 // Default is the default Client implementation
@@ -23,20 +24,38 @@ type Client interface {
 type client struct {
 	datadog *statsd.Client
 	tags    []string
+	clock   clock.Clock
+}
+
+// Option customizes the datadog client
+type Option func(c *client)
+
+// WithClock sets the clock used to measure timings. Use a fake clock in tests
+func WithClock(clk clock.Clock) Option {
+	return func(c *client) {
+		c.clock = clk
+	}
 }
 
 // New creates a new datadog client
-func New(addr, namespace string) (Client, error) {
+func New(addr, namespace string, options ...Option) (Client, error) {
 	datadog, err := statsd.New(addr)
 	if err != nil {
 		return nil, err
 	}
 	datadog.Namespace = namespace + "."
 
-	return &client{
+	c := &client{
 		datadog: datadog,
 		tags:    []string{},
-	}, nil
+		clock:   clock.New(),
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c, nil
 }
 
 // WithTags returns a new client with default tag values
@@ -66,7 +85,7 @@ func (c *client) Histogram(name string, value float64) error {
 }
 
 func (c *client) Timing(name string, start time.Time) error {
-	return c.datadog.Timing(name, time.Duration(time.Now().Sub(start)), c.tags, 1.0)
+	return c.datadog.Timing(name, c.clock.Since(start), c.tags, 1.0)
 }
 
 // Null implementation
@@ -1,8 +1,12 @@
 package metrics
 
 import (
+	"net"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/fchoquet/golibs/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,3 +26,42 @@ func TestWithTags(t *testing.T) {
 	assert.Equal([]string{"foo", "bar"}, c2.(*client).tags)
 	assert.Equal([]string{"foo", "bar", "baz"}, c3.(*client).tags)
 }
+
+func TestTimingUsesTheClock(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer conn.Close()
+
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	client, err := New(conn.LocalAddr().String(), "test", WithClock(c))
+	assert.NoError(err)
+
+	start := c.Now()
+	c.Advance(1500 * time.Millisecond)
+	assert.NoError(client.Timing("duration", start))
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(buf[:n]), "test.duration:1500"), string(buf[:n]))
+}
+
+func TestRecorder(t *testing.T) {
+	assert := assert.New(t)
+
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	recorder := NewRecorder(c)
+
+	start := c.Now()
+	c.Advance(1500 * time.Millisecond)
+	recorder.WithTag("foo").Timing("duration", start)
+	recorder.WithTags([]string{"foo", "bar"}).Histogram("size", 3)
+	recorder.Incr("count")
+
+	assert.Equal([]string{"duration [foo]", "size [foo bar]", "count []"}, recorder.Calls())
+	assert.Equal([]float64{1500}, recorder.Values("duration"))
+	assert.Equal([]float64{3}, recorder.Values("size"))
+}
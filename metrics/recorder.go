@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+)
+
+// Recorder is a Client keeping every call in memory. Use it in tests to check the metrics sent by your code
+// Clients returned by WithTags and WithTag share the records of their parent. It is safe for concurrent use
+type Recorder struct {
+	tags   []string
+	clock  clock.Clock
+	mutex  *sync.Mutex
+	calls  *[]string
+	values map[string][]float64
+}
+
+// NewRecorder returns an empty Recorder measuring timings with clk
+func NewRecorder(clk clock.Clock) *Recorder {
+	return &Recorder{
+		tags:   []string{},
+		clock:  clk,
+		mutex:  &sync.Mutex{},
+		calls:  &[]string{},
+		values: map[string][]float64{},
+	}
+}
+
+// Calls returns the recorded calls, formatted as "name [tags]"
+func (r *Recorder) Calls() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, *r.calls...)
+}
+
+// Values returns the values recorded for name, whatever their tags
+// Timings are recorded in milliseconds
+func (r *Recorder) Values(name string) []float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]float64{}, r.values[name]...)
+}
+
+// WithTags returns a new recorder with default tag values
+func (r *Recorder) WithTags(tags []string) Client {
+	newRecorder := *r
+	newRecorder.tags = append(append([]string{}, r.tags...), tags...)
+	return &newRecorder
+}
+
+// WithTag returns a new recorder with a default tag value
+func (r *Recorder) WithTag(tag string) Client {
+	return r.WithTags([]string{tag})
+}
+
+// Gauge records a gauge
+func (r *Recorder) Gauge(name string, value float64) error {
+	return r.record(name, value)
+}
+
+// Incr records a counter increment
+func (r *Recorder) Incr(name string) error {
+	return r.record(name, 1)
+}
+
+// Histogram records a histogram value
+func (r *Recorder) Histogram(name string, value float64) error {
+	return r.record(name, value)
+}
+
+// Timing records the time elapsed since start
+func (r *Recorder) Timing(name string, start time.Time) error {
+	return r.record(name, float64(r.clock.Since(start))/float64(time.Millisecond))
+}
+
+func (r *Recorder) record(name string, value float64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	*r.calls = append(*r.calls, fmt.Sprintf("%s %v", name, r.tags))
+	r.values[name] = append(r.values[name], value)
+	return nil
+}
@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/fchoquet/golibs/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxBatchSize is the maximum number of entries in an SQS batch request
+const MaxBatchSize = 10
+
+// maxAckAttempts is the maximum number of times an ack is sent before giving up
+const maxAckAttempts = 3
+
+// pendingAck is an ack waiting to be sent
+type pendingAck struct {
+	msg      *Message
+	attempts int
+}
+
+// listenAck buffers acks and deletes them by batches, until ack is closed
+func listenAck(q *queue, ack <-chan *Message) {
+	var pending []pendingAck
+	// timer is only running when acks are buffered
+	var timer clock.Timer
+	var flush <-chan time.Time
+
+	send := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, flush = nil, nil
+		}
+		pending = deleteMessages(q, pending)
+	}
+
+	for {
+		select {
+		case msg, ok := <-ack:
+			if !ok {
+				flushAcks(q, pending)
+				return
+			}
+
+			pending = append(pending, pendingAck{msg: msg})
+			if len(pending) >= q.ackBatchSize {
+				send()
+			}
+
+		case <-flush:
+			send()
+		}
+
+		if len(pending) > 0 && timer == nil {
+			timer = q.clock.NewTimer(q.ackInterval)
+			flush = timer.C()
+		}
+	}
+}
+
+// flushAcks sends the pending acks until they are all deleted or have failed too many times
+func flushAcks(q *queue, pending []pendingAck) {
+	for len(pending) > 0 {
+		pending = deleteMessages(q, pending)
+	}
+}
+
+// deleteMessages deletes the pending messages by batches of ackBatchSize
+// It returns the acks that failed and can be sent again
+func deleteMessages(q *queue, pending []pendingAck) []pendingAck {
+	var retry []pendingAck
+	for len(pending) > 0 {
+		n := q.ackBatchSize
+		if n > len(pending) {
+			n = len(pending)
+		}
+		retry = append(retry, deleteBatch(q, pending[:n])...)
+		pending = pending[n:]
+	}
+	return retry
+}
+
+// deleteBatch deletes a single batch of messages and returns the acks to retry
+func deleteBatch(q *queue, batch []pendingAck) []pendingAck {
+	q.metrics.Histogram(QueueAckBatchSize, float64(len(batch)))
+	start := q.clock.Now()
+
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+	for i, a := range batch {
+		// like ok and error, tried is counted per message
+		q.metrics.Incr(QueueAckTried)
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			// ids only need to be unique in the batch
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(a.msg.ReceiptHandle),
+		}
+	}
+
+	output, err := q.service.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: &q.url,
+		Entries:  entries,
+	})
+	q.metrics.Timing(QueueAckTime, start)
+
+	if err != nil {
+		q.logger.WithError(err).Error("Could not delete messages")
+		var retry []pendingAck
+		for _, a := range batch {
+			q.metrics.Incr(QueueAckErr)
+			if a, ok := nextAttempt(a); ok {
+				retry = append(retry, a)
+			}
+		}
+		return retry
+	}
+
+	if len(output.Failed) > 0 {
+		q.metrics.Incr(QueueAckPartialFailure)
+	}
+
+	var retry []pendingAck
+	for _, failed := range output.Failed {
+		i, err := strconv.Atoi(aws.StringValue(failed.Id))
+		if err != nil || i < 0 || i >= len(batch) {
+			continue
+		}
+		a := batch[i]
+
+		q.metrics.Incr(QueueAckErr)
+		q.logger.WithFields(log.Fields{
+			"message_id": a.msg.MessageID,
+			"code":       aws.StringValue(failed.Code),
+		}).Error("Could not delete message: " + aws.StringValue(failed.Message))
+
+		if aws.BoolValue(failed.SenderFault) {
+			// the request is invalid, the receipt handle has probably expired. Sending it again won't help
+			// There's not much we can do here. Message is already processed and we can't rollback
+			// We'll get a duplicate
+			continue
+		}
+		if a, ok := nextAttempt(a); ok {
+			retry = append(retry, a)
+		}
+	}
+
+	for range output.Successful {
+		q.metrics.Incr(QueueAckOk)
+	}
+
+	return retry
+}
+
+// nextAttempt returns the ack to send again, or false if it has already been sent too many times
+func nextAttempt(a pendingAck) (pendingAck, bool) {
+	a.attempts++
+	return a, a.attempts < maxAckAttempts
+}
@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcksAreSentByBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newAckTestService(3)
+	q := newTestQueue(service, AckBatch(2, time.Hour))
+
+	c, _ := q.Listen()
+	for i := 0; i < 3; i++ {
+		(<-c).Ack()
+	}
+
+	// the first batch is full
+	assert.Eventually(func() bool {
+		return len(service.deleted()) == 2
+	}, time.Second, time.Millisecond)
+
+	// the last one is flushed on shutdown
+	assert.Nil(q.Stop(context.Background()))
+	assert.Equal([]string{"receipt-handle-0", "receipt-handle-1", "receipt-handle-2"}, service.deleted())
+	assert.Equal([]int{2, 1}, service.batches)
+}
+
+func TestAcksAreSentAfterTheInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newAckTestService(2)
+	clk := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	q := newTestQueue(service, WithClock(clk))
+
+	c, _ := q.Listen()
+	(<-c).Ack()
+	(<-c).Ack()
+
+	// the flush timer is the only waiter
+	clk.BlockUntil(1)
+	assert.Empty(service.deleted())
+
+	clk.Advance(1 * time.Second)
+	assert.Eventually(func() bool {
+		return len(service.deleted()) == 2
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(q.Stop(context.Background()))
+	assert.Equal([]int{2}, service.batches)
+}
+
+func TestFailedAcksAreRetried(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newAckTestService(3)
+	service.failures = map[string]bool{
+		// server error, retried
+		"receipt-handle-1": false,
+		// sender fault, dropped
+		"receipt-handle-2": true,
+	}
+	recorder := metrics.NewRecorder(clock.New())
+	q := newTestQueue(service, AckBatch(3, time.Hour))
+	q.metrics = recorder
+
+	c, _ := q.Listen()
+	for i := 0; i < 3; i++ {
+		(<-c).Ack()
+	}
+
+	assert.Nil(q.Stop(context.Background()))
+	assert.Equal([]string{"receipt-handle-0"}, service.deleted())
+	// receipt-handle-1 is sent maxAckAttempts times
+	assert.Equal([]int{3, 1, 1}, service.batches)
+
+	counts := map[string]int{}
+	for _, call := range recorder.Calls() {
+		counts[call]++
+	}
+	assert.Equal(5, counts["queue.ack.tried []"])
+	assert.Equal(1, counts["queue.ack.ok []"])
+	assert.Equal(4, counts["queue.ack.error []"])
+	assert.Equal(3, counts["queue.ack.partial_failure []"])
+}
+
+func TestAcksAreRetriedWhenTheRequestFails(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newAckTestService(1)
+	service.batchErr = errors.New("unavailable")
+	q := newTestQueue(service)
+
+	c, _ := q.Listen()
+	(<-c).Ack()
+
+	assert.Nil(q.Stop(context.Background()))
+	assert.Equal([]int{1, 1, 1}, service.batches)
+	assert.Empty(service.deleted())
+}
+
+// newAckTestService creates a mock SQS service with n messages
+func newAckTestService(n int) *mockSQSClient {
+	service := &mockSQSClient{
+		mutex: &sync.Mutex{},
+	}
+	for i := 0; i < n; i++ {
+		service.messages = append(service.messages, &sqs.Message{
+			Body:          aws.String(fmt.Sprintf("this is message #%d", i)),
+			ReceiptHandle: aws.String(fmt.Sprintf("receipt-handle-%d", i)),
+			MessageId:     aws.String(fmt.Sprintf("message-id-%d", i)),
+		})
+	}
+	return service
+}
@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Attribute data types supported by SQS
+// A custom type can be appended to them, "Number.int" for instance
+const (
+	StringType = "String"
+	NumberType = "Number"
+	BinaryType = "Binary"
+)
+
+// MessageAttribute is a typed message attribute
+type MessageAttribute struct {
+	DataType    string `json:"data_type"`
+	StringValue string `json:"string_value,omitempty"`
+	BinaryValue []byte `json:"binary_value,omitempty"`
+}
+
+// StringAttribute creates a String attribute
+func StringAttribute(value string) MessageAttribute {
+	return MessageAttribute{DataType: StringType, StringValue: value}
+}
+
+// NumberAttribute creates a Number attribute
+func NumberAttribute(value float64) MessageAttribute {
+	return MessageAttribute{DataType: NumberType, StringValue: strconv.FormatFloat(value, 'f', -1, 64)}
+}
+
+// BinaryAttribute creates a Binary attribute
+func BinaryAttribute(value []byte) MessageAttribute {
+	return MessageAttribute{DataType: BinaryType, BinaryValue: value}
+}
+
+// IsString returns true for String attributes, custom types included
+func (a MessageAttribute) IsString() bool {
+	return a.baseType() == StringType
+}
+
+// IsNumber returns true for Number attributes, custom types included
+func (a MessageAttribute) IsNumber() bool {
+	return a.baseType() == NumberType
+}
+
+// IsBinary returns true for Binary attributes, custom types included
+func (a MessageAttribute) IsBinary() bool {
+	return a.baseType() == BinaryType
+}
+
+// Number parses the value of a Number attribute
+func (a MessageAttribute) Number() (float64, error) {
+	return strconv.ParseFloat(a.StringValue, 64)
+}
+
+func (a MessageAttribute) baseType() string {
+	return strings.SplitN(a.DataType, ".", 2)[0]
+}
+
+// systemAttributes are the system attributes requested when receiving messages
+var systemAttributes = []string{
+	sqs.MessageSystemAttributeNameApproximateReceiveCount,
+	sqs.MessageSystemAttributeNameSentTimestamp,
+	sqs.MessageSystemAttributeNameMessageGroupId,
+	sqs.MessageSystemAttributeNameMessageDeduplicationId,
+}
+
+// fromSQSAttributes converts the message attributes received from SQS
+func fromSQSAttributes(attributes map[string]*sqs.MessageAttributeValue) map[string]MessageAttribute {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	converted := make(map[string]MessageAttribute, len(attributes))
+	for name, value := range attributes {
+		converted[name] = MessageAttribute{
+			DataType:    aws.StringValue(value.DataType),
+			StringValue: aws.StringValue(value.StringValue),
+			BinaryValue: value.BinaryValue,
+		}
+	}
+	return converted
+}
+
+// toSQSAttributes converts message attributes to send them to SQS
+func toSQSAttributes(attributes map[string]MessageAttribute) map[string]*sqs.MessageAttributeValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	converted := make(map[string]*sqs.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		v := &sqs.MessageAttributeValue{
+			DataType: aws.String(value.DataType),
+		}
+		if value.IsBinary() {
+			v.BinaryValue = value.BinaryValue
+		} else {
+			v.StringValue = aws.String(value.StringValue)
+		}
+		converted[name] = v
+	}
+	return converted
+}
+
+// receiveCount returns the approximate number of times msg has been received, or 0 if unknown
+func receiveCount(msg *sqs.Message) int {
+	count, err := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// sentTimestamp returns the time msg was sent to the queue, or the zero time if unknown
+func sentTimestamp(msg *sqs.Message) time.Time {
+	ms, err := strconv.ParseInt(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
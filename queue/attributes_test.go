@@ -0,0 +1,51 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttributeTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(StringAttribute("foo").IsString())
+	assert.True(BinaryAttribute([]byte("foo")).IsBinary())
+
+	custom := MessageAttribute{DataType: "Number.float", StringValue: "1.5"}
+	assert.True(custom.IsNumber())
+	assert.False(custom.IsString())
+
+	n, err := custom.Number()
+	assert.Nil(err)
+	assert.Equal(1.5, n)
+
+	n, err = NumberAttribute(42).Number()
+	assert.Nil(err)
+	assert.Equal(42.0, n)
+
+	_, err = StringAttribute("foo").Number()
+	assert.NotNil(err)
+}
+
+func TestAttributesConversion(t *testing.T) {
+	assert := assert.New(t)
+
+	attributes := map[string]MessageAttribute{
+		"name":    StringAttribute("foo"),
+		"count":   NumberAttribute(3),
+		"payload": BinaryAttribute([]byte{1, 2, 3}),
+	}
+
+	converted := toSQSAttributes(attributes)
+	assert.Equal(&sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("foo")}, converted["name"])
+	assert.Equal(&sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("3")}, converted["count"])
+	assert.Equal(&sqs.MessageAttributeValue{DataType: aws.String("Binary"), BinaryValue: []byte{1, 2, 3}}, converted["payload"])
+
+	assert.Equal(attributes, fromSQSAttributes(converted))
+
+	assert.Nil(toSQSAttributes(nil))
+	assert.Nil(fromSQSAttributes(nil))
+}
@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	QueueQuarantined     = "queue.quarantined"
+	QueueQuarantineError = "queue.quarantine.error"
+)
+
+// attributes added to quarantined messages
+// OriginalAttributesAttribute holds, as a JSON object, the original attributes that do not fit in MaxAttributes
+var (
+	FailureReasonAttribute      = "failure_reason"
+	StackTraceAttribute         = "stack_trace"
+	OriginalAttributesAttribute = "original_attributes"
+)
+
+// MaxAttributes is the maximum number of attributes of an SQS message
+const MaxAttributes = 10
+
+// maxStackTraceSize is the maximum size of the stack trace attached to a quarantined message
+const maxStackTraceSize = 16 << 10
+
+// unknownFailureReason is the failure reason of errors without message. SQS rejects empty attributes
+const unknownFailureReason = "unknown error"
+
+// shouldQuarantine returns true if msg has been received too many times
+func (w *worker) shouldQuarantine(msg *Message) bool {
+	return w.deadLetter != nil && w.maxReceives > 0 && msg.ReceiveCount >= w.maxReceives
+}
+
+// quarantine sends a copy of msg to the dead-letter queue, with the reason of its failure
+// It returns false if the message could not be sent
+func (w *worker) quarantine(ctx context.Context, msg *Message, err error) bool {
+	logger := w.logger.WithField("message_id", msg.MessageID)
+
+	id, sendErr := w.deadLetter.Send(ctx, deadLetterMessage(msg, err))
+	if sendErr != nil {
+		// the message stays in the source queue and will be quarantined next time
+		logger.WithError(sendErr).Error("Could not quarantine message")
+		w.metrics.Incr(QueueQuarantineError)
+		return false
+	}
+
+	logger.WithFields(log.Fields{
+		"receive_count":          msg.ReceiveCount,
+		"dead_letter_message_id": id,
+	}).Warn("Message quarantined")
+	w.metrics.Incr(QueueQuarantined)
+	return true
+}
+
+// deadLetterMessage creates a copy of msg to send to a dead-letter queue, with the reason of its failure
+func deadLetterMessage(msg *Message, err error) *OutgoingMessage {
+	added := map[string]MessageAttribute{
+		FailureReasonAttribute: StringAttribute(failureReason(err)),
+	}
+	if p, ok := err.(panicError); ok && len(p.stack) > 0 {
+		stack := p.stack
+		if len(stack) > maxStackTraceSize {
+			stack = stack[:maxStackTraceSize]
+		}
+		added[StackTraceAttribute] = StringAttribute(string(stack))
+	}
+
+	attributes := fitAttributes(msg.Attributes, MaxAttributes-len(added))
+	for name, value := range added {
+		attributes[name] = value
+	}
+
+	return &OutgoingMessage{
+		Body:                   msg.Body,
+		Attributes:             attributes,
+		MessageGroupID:         msg.MessageGroupID,
+		MessageDeduplicationID: msg.MessageDeduplicationID,
+	}
+}
+
+func failureReason(err error) string {
+	if reason := err.Error(); reason != "" {
+		return reason
+	}
+	return unknownFailureReason
+}
+
+// fitAttributes copies attributes into at most max attributes
+// When there are too many of them, the last ones in name order are merged into OriginalAttributesAttribute
+func fitAttributes(attributes map[string]MessageAttribute, max int) map[string]MessageAttribute {
+	fitted := make(map[string]MessageAttribute, max+2)
+	if len(attributes) <= max {
+		for name, value := range attributes {
+			fitted[name] = value
+		}
+		return fitted
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// one attribute is used by the merged ones
+	kept := max - 1
+	merged := make(map[string]MessageAttribute, len(names)-kept)
+	for i, name := range names {
+		if i < kept {
+			fitted[name] = attributes[name]
+		} else {
+			merged[name] = attributes[name]
+		}
+	}
+
+	// a map of attributes is always marshallable
+	encoded, _ := json.Marshal(merged)
+	fitted[OriginalAttributesAttribute] = StringAttribute(string(encoded))
+	return fitted
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerQuarantinesPoisonMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("first", "poison")
+	l.messages[0].ReceiveCount = 2
+	l.messages[1].ReceiveCount = 3
+	l.messages[1].Body = "poison body"
+	l.messages[1].Attributes = map[string]MessageAttribute{"trace_id": StringAttribute("abc")}
+
+	dlq := NewMemoryPublisher()
+	recorder := metrics.NewRecorder(clock.New())
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		return errors.New("invalid payload")
+	})
+
+	w := NewWorker(l, handler, 1, logrus.StandardLogger(), recorder, DeadLetter(dlq, 3))
+	assert.Nil(w.Run(context.Background()))
+
+	// only the message received too many times is quarantined, then acknowledged
+	assert.Equal([]string{"first"}, l.released())
+	assert.Equal([]string{"poison"}, l.acked())
+
+	assert.Len(dlq.Messages(), 1)
+	quarantined := dlq.Messages()[0]
+	assert.Equal("poison body", quarantined.Body)
+	assert.Equal(StringAttribute("abc"), quarantined.Attributes["trace_id"])
+	assert.Equal(StringAttribute("invalid payload"), quarantined.Attributes[FailureReasonAttribute])
+	_, ok := quarantined.Attributes[StackTraceAttribute]
+	assert.False(ok)
+
+	assert.Contains(recorder.Calls(), "queue.quarantined []")
+	assert.Contains(recorder.Calls(), "queue.handled [outcome:quarantined]")
+}
+
+func TestWorkerAttachesTheStackTraceOfPanics(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("poison")
+	l.messages[0].ReceiveCount = 1
+
+	dlq := NewMemoryPublisher()
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		panic("oops")
+	})
+
+	w := NewWorker(l, handler, 1, logrus.StandardLogger(), metrics.Default, DeadLetter(dlq, 1))
+	assert.Nil(w.Run(context.Background()))
+
+	assert.Len(dlq.Messages(), 1)
+	attributes := dlq.Messages()[0].Attributes
+	assert.Equal("panic: oops", attributes[FailureReasonAttribute].StringValue)
+	assert.True(strings.Contains(attributes[StackTraceAttribute].StringValue, "runtime/debug.Stack"))
+}
+
+func TestWorkerKeepsMessagesThatCouldNotBeQuarantined(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("poison")
+	l.messages[0].ReceiveCount = 5
+
+	dlq := NewMemoryPublisher()
+	dlq.Err = errors.New("unavailable")
+	recorder := metrics.NewRecorder(clock.New())
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		return errors.New("invalid payload")
+	})
+
+	w := NewWorker(l, handler, 1, logrus.StandardLogger(), recorder, DeadLetter(dlq, 3))
+	assert.Nil(w.Run(context.Background()))
+
+	assert.Empty(l.acked())
+	assert.Equal([]string{"poison"}, l.released())
+	assert.Contains(recorder.Calls(), "queue.quarantine.error []")
+	assert.Contains(recorder.Calls(), "queue.handled [outcome:error]")
+}
+
+func TestWorkerDoesNotQuarantineMessagesSettledByTheHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("poison")
+	l.messages[0].ReceiveCount = 5
+
+	dlq := NewMemoryPublisher()
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		m.Nack()
+		return errors.New("invalid payload")
+	})
+
+	w := NewWorker(l, handler, 1, logrus.StandardLogger(), metrics.Default, DeadLetter(dlq, 3))
+	assert.Nil(w.Run(context.Background()))
+
+	// the handler chose to requeue the message, so it is neither quarantined nor acknowledged
+	assert.Empty(dlq.Messages())
+	assert.Empty(l.acked())
+	assert.Equal([]string{"poison"}, l.released())
+}
+
+func TestDeadLetterMessagesFitInMaxAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := &Message{Attributes: map[string]MessageAttribute{}}
+	for i := 0; i < 12; i++ {
+		msg.Attributes[fmt.Sprintf("attr_%02d", i)] = StringAttribute(fmt.Sprint(i))
+	}
+
+	quarantined := deadLetterMessage(msg, panicError{value: "oops", stack: []byte("stack")})
+	assert.Len(quarantined.Attributes, MaxAttributes)
+	assert.Equal(StringAttribute("panic: oops"), quarantined.Attributes[FailureReasonAttribute])
+	assert.Equal(StringAttribute("stack"), quarantined.Attributes[StackTraceAttribute])
+
+	// the first attributes in name order are kept, the others are merged
+	for i := 0; i < 7; i++ {
+		assert.Equal(StringAttribute(fmt.Sprint(i)), quarantined.Attributes[fmt.Sprintf("attr_%02d", i)])
+	}
+	var merged map[string]MessageAttribute
+	assert.NoError(json.Unmarshal([]byte(quarantined.Attributes[OriginalAttributesAttribute].StringValue), &merged))
+	assert.Len(merged, 5)
+	assert.Equal(StringAttribute("11"), merged["attr_11"])
+}
+
+func TestDeadLetterMessagesAlwaysHaveAFailureReason(t *testing.T) {
+	quarantined := deadLetterMessage(&Message{}, errors.New(""))
+	assert.Equal(t, StringAttribute(unknownFailureReason), quarantined.Attributes[FailureReasonAttribute])
+}
@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// MemoryPublisher is an in-memory implementation of the Publisher interface
+// It records the sent messages. To be used in tests
+type MemoryPublisher struct {
+	mutex    sync.Mutex
+	messages []*OutgoingMessage
+	// Err is returned by Send and SendBatch when not nil
+	Err error
+}
+
+// NewMemoryPublisher creates an in-memory publisher
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+// Send records the message. Message ids are the positions of the messages in the sent list
+func (p *MemoryPublisher) Send(ctx context.Context, m *OutgoingMessage) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.Err != nil {
+		return "", p.Err
+	}
+
+	p.messages = append(p.messages, m)
+	return strconv.Itoa(len(p.messages) - 1), nil
+}
+
+// SendBatch records the messages
+func (p *MemoryPublisher) SendBatch(ctx context.Context, messages []*OutgoingMessage) ([]string, error) {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		id, err := p.Send(ctx, m)
+		if err != nil {
+			errs := map[int]error{}
+			for j := i; j < len(messages); j++ {
+				errs[j] = err
+			}
+			return ids, &BatchError{Errors: errs}
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// Messages returns the messages sent so far
+func (p *MemoryPublisher) Messages() []*OutgoingMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]*OutgoingMessage{}, p.messages...)
+}
+
+// Reset forgets the messages sent so far
+func (p *MemoryPublisher) Reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.messages = nil
+}
@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fchoquet/golibs/retry"
+)
+
+// MaxVisibilityTimeout is the longest visibility timeout accepted by SQS
+const MaxVisibilityTimeout = 12 * time.Hour
+
+// Message reprensents a queue message
+type Message struct {
+	MessageID     string `json:"message_id"`
+	Body          string `json:"body"`
+	ReceiptHandle string `json:"receipt_handle"`
+	// Attributes are the message attributes set by the sender
+	Attributes map[string]MessageAttribute `json:"attributes"`
+	// ReceiveCount is the approximate number of times the message has been received, including this one
+	ReceiveCount int `json:"receive_count"`
+	// SentTimestamp is the time the message was sent to the queue
+	SentTimestamp time.Time `json:"sent_timestamp"`
+	// MessageGroupID and MessageDeduplicationID are only set for FIFO queues
+	MessageGroupID         string `json:"message_group_id"`
+	MessageDeduplicationID string `json:"message_deduplication_id"`
+	acker                  acker
+	settled                sync.Once
+	isSettled              atomic.Bool
+	heartbeat              *heartbeat
+}
+
+// acker processes acknowledgements on behalf of a Listener
+type acker interface {
+	ack(m *Message)
+	release(m *Message)
+	changeVisibility(m *Message, d time.Duration) error
+}
+
+// heartbeat extends the visibility of a message in the background
+// stop is closed when the message is settled and done once the heartbeat has returned
+type heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Ack acknowledges the message
+// Only the first call to Ack, Release, Nack or RequeueAfter has an effect
+func (m *Message) Ack() {
+	m.settle(func(a acker) {
+		a.ack(m)
+	})
+}
+
+// Release gives the message up without acknowledging it
+// It will be received again once its visibility timeout expires
+// Only the first call to Ack, Release, Nack or RequeueAfter has an effect
+func (m *Message) Release() {
+	m.settle(func(a acker) {
+		a.release(m)
+	})
+}
+
+// Nack gives the message up without acknowledging it and makes it visible again immediately
+// Only the first call to Ack, Release, Nack or RequeueAfter has an effect
+func (m *Message) Nack() {
+	m.RequeueAfter(0)
+}
+
+// RequeueAfter gives the message up without acknowledging it. It will be received again after d
+// d is capped to MaxVisibilityTimeout
+// Only the first call to Ack, Release, Nack or RequeueAfter has an effect
+func (m *Message) RequeueAfter(d time.Duration) {
+	if d > MaxVisibilityTimeout {
+		d = MaxVisibilityTimeout
+	}
+
+	m.settle(func(a acker) {
+		// if it fails, the message will be received again once its current visibility timeout expires
+		a.changeVisibility(m, d)
+		a.release(m)
+	})
+}
+
+// RequeueWithBackoff requeues the message after a delay computed from its receive count
+// The first failure waits for backoff(1), the second one for backoff(2) and so on
+func (m *Message) RequeueWithBackoff(backoff retry.BackOffFunc) {
+	count := m.ReceiveCount
+	if count < 1 {
+		count = 1
+	}
+	m.RequeueAfter(backoff(count))
+}
+
+// ChangeVisibility sets the visibility timeout of the message to d from now
+// The message is received again if it is not acknowledged before
+func (m *Message) ChangeVisibility(d time.Duration) error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.changeVisibility(m, d)
+}
+
+// settle stops the heartbeat and calls f the first time the message is settled
+func (m *Message) settle(f func(a acker)) {
+	m.settled.Do(func() {
+		m.isSettled.Store(true)
+		if m.heartbeat != nil {
+			close(m.heartbeat.stop)
+			<-m.heartbeat.done
+		}
+		if m.acker != nil {
+			f(m.acker)
+		}
+	})
+}
@@ -1,9 +1,11 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,22 +17,36 @@ import (
 type mock struct {
 	path   string
 	logger log.FieldLogger
+	listenerOptions
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewMock creates a mock listener
-func NewMock(path string, logger log.FieldLogger) Listener {
+// Only WithClock is relevant to it: the other ListenerOptions are ignored
+func NewMock(path string, logger log.FieldLogger, opts ...ListenerOption) Listener {
 	return &mock{
-		path:   path,
-		logger: logger,
+		path:            path,
+		logger:          logger,
+		listenerOptions: newListenerOptions(opts),
 	}
 }
 
 func (m *mock) Listen() (<-chan *Message, <-chan error) {
 	c := make(chan *Message)
-	ack := make(chan *Message)
 	e := make(chan error)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+
 	go func() {
+		defer close(m.done)
+		defer close(e)
+		defer close(c)
+
 		data, err := ioutil.ReadFile(m.path)
 		if err != nil {
 			// It should not happen, let's not add confusion to our tests
@@ -44,28 +60,67 @@ func (m *mock) Listen() (<-chan *Message, <-chan error) {
 		}
 
 		for _, msg := range fixtures {
-			msg.ack = ack
-			c <- msg
-			time.Sleep(100 * time.Millisecond)
+			msg.acker = m
+			select {
+			case c <- msg:
+			case <-ctx.Done():
+				return
+			}
+			m.sleep(ctx, 100*time.Millisecond)
 		}
 
 		// push an error when no fixtures left
-		e <- errors.New("No more messages")
-
-		time.Sleep(100 * time.Millisecond)
-		close(c)
-	}()
-
-	go func() {
-		// listen to ack message but simply log them
-		for msg := range ack {
-			m.logger.WithField("ReceiptHandle", msg.ReceiptHandle).Debug("Mock listener: Ack message")
+		select {
+		case e <- errors.New("No more messages"):
+		case <-ctx.Done():
+			return
 		}
+
+		m.sleep(ctx, 100*time.Millisecond)
 	}()
 
 	return c, e
 }
 
+// ack simply logs the acknowledged message
+func (m *mock) ack(msg *Message) {
+	m.logger.WithField("ReceiptHandle", msg.ReceiptHandle).Debug("Mock listener: Ack message")
+}
+
+// release simply logs the released message
+func (m *mock) release(msg *Message) {
+	m.logger.WithField("ReceiptHandle", msg.ReceiptHandle).Debug("Mock listener: Release message")
+}
+
+// changeVisibility simply logs the new visibility timeout
+func (m *mock) changeVisibility(msg *Message, d time.Duration) error {
+	m.logger.WithField("ReceiptHandle", msg.ReceiptHandle).Debugf("Mock listener: Change visibility to %s", d)
+	return nil
+}
+
+func (m *mock) sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-m.clock.After(d):
+	case <-ctx.Done():
+	}
+}
+
 func (m *mock) LastRequest() *time.Duration {
 	return nil
 }
+
+func (m *mock) Stop(ctx context.Context) error {
+	var err error
+	m.stopOnce.Do(func() {
+		if m.cancel == nil {
+			return
+		}
+		m.cancel()
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
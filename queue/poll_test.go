@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollingIsConfigurable(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &pollSQSClient{}
+	q := newTestQueue(service, MaxMessages(5), WaitTime(5*time.Second), VisibilityTimeout(2*time.Minute), IdleBackoff(retry.Constant(time.Hour)))
+
+	q.Listen()
+	assert.Eventually(func() bool {
+		return len(service.inputs()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Nil(q.Stop(context.Background()))
+
+	input := service.inputs()[0]
+	assert.Equal(int64(5), *input.MaxNumberOfMessages)
+	assert.Equal(int64(5), *input.WaitTimeSeconds)
+	assert.Equal(int64(120), *input.VisibilityTimeout)
+}
+
+func TestPollingPausesWhenTooManyMessagesAreInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &pollSQSClient{available: 5}
+	q := newTestQueue(service, MaxInFlight(2))
+
+	c, _ := q.Listen()
+	first := <-c
+	<-c
+
+	// only 2 messages were requested, and polling is paused
+	assert.Equal([]int64{2}, service.requested())
+
+	first.Release()
+	<-c
+	assert.Equal([]int64{2, 1}, service.requested())
+}
+
+func TestMultiplePollers(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &pollSQSClient{block: true}
+	q := newTestQueue(service, Pollers(3))
+
+	q.Listen()
+	assert.Eventually(func() bool {
+		return service.activeRequests() == 3
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(q.Stop(context.Background()))
+	assert.Equal(0, service.activeRequests())
+}
+
+func TestIdlePollingBacksOff(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &pollSQSClient{}
+	clk := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	q := newTestQueue(service, WithClock(clk), IdleBackoff(retry.Linear(time.Second, time.Minute)))
+
+	q.Listen()
+
+	// first empty response: waits for 1 second
+	clk.BlockUntil(1)
+	assert.Len(service.inputs(), 1)
+	clk.Advance(time.Second)
+
+	// second empty response: waits for 2 seconds
+	assert.Eventually(func() bool {
+		return len(service.inputs()) == 2 && clk.Waiters() == 1
+	}, time.Second, time.Millisecond)
+	clk.Advance(time.Second)
+	assert.Equal(1, clk.Waiters())
+	assert.Len(service.inputs(), 2)
+
+	clk.Advance(time.Second)
+	assert.Eventually(func() bool {
+		return len(service.inputs()) == 3
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(q.Stop(context.Background()))
+}
+
+// Mock implementation of SQS used to test polling
+type pollSQSClient struct {
+	sqsiface.SQSAPI
+	// available is the number of messages left in the queue
+	available int
+	// block makes receive requests wait until they are cancelled
+	block bool
+
+	mutex    sync.Mutex
+	received []*sqs.ReceiveMessageInput
+	active   int
+	sent     int
+}
+
+func (c *pollSQSClient) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	c.mutex.Lock()
+	c.received = append(c.received, input)
+	c.active++
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.active--
+		c.mutex.Unlock()
+	}()
+
+	if c.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	output := &sqs.ReceiveMessageOutput{}
+	for i := int64(0); i < *input.MaxNumberOfMessages && c.available > 0; i++ {
+		output.Messages = append(output.Messages, &sqs.Message{
+			Body:          aws.String(fmt.Sprintf("this is message #%d", c.sent)),
+			ReceiptHandle: aws.String(fmt.Sprintf("receipt-handle-%d", c.sent)),
+			MessageId:     aws.String(fmt.Sprintf("message-id-%d", c.sent)),
+		})
+		c.available--
+		c.sent++
+	}
+	return output, nil
+}
+
+func (c *pollSQSClient) inputs() []*sqs.ReceiveMessageInput {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*sqs.ReceiveMessageInput{}, c.received...)
+}
+
+func (c *pollSQSClient) requested() []int64 {
+	var counts []int64
+	for _, input := range c.inputs() {
+		counts = append(counts, *input.MaxNumberOfMessages)
+	}
+	return counts
+}
+
+func (c *pollSQSClient) activeRequests() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.active
+}
@@ -0,0 +1,243 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	QueuePublishTried = "queue.publish.tried"
+	QueuePublishOk    = "queue.publish.ok"
+	QueuePublishErr   = "queue.publish.error"
+	QueuePublishTime  = "queue.publish.time"
+)
+
+// MaxDelay is the longest delivery delay accepted by SQS
+const MaxDelay = 15 * time.Minute
+
+// OutgoingMessage is a message to publish
+type OutgoingMessage struct {
+	Body string
+	// Delay postpones the delivery of the message. It is capped to MaxDelay
+	// FIFO queues do not support per-message delays
+	Delay      time.Duration
+	Attributes map[string]MessageAttribute
+	// MessageGroupID is required for FIFO queues
+	MessageGroupID string
+	// MessageDeduplicationID is required for FIFO queues without content-based deduplication
+	MessageDeduplicationID string
+}
+
+// JSONMessage creates a message whose body is the JSON encoding of v
+func JSONMessage(v interface{}) (*OutgoingMessage, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &OutgoingMessage{Body: string(body)}, nil
+}
+
+// Publisher sends messages to a queue
+type Publisher interface {
+	// Send sends a message and returns its id
+	Send(ctx context.Context, m *OutgoingMessage) (string, error)
+	// SendBatch sends messages by batches of MaxBatchSize and returns their ids, in the same order
+	// A *BatchError is returned if some messages could not be sent. Their ids are left empty
+	SendBatch(ctx context.Context, messages []*OutgoingMessage) ([]string, error)
+}
+
+// BatchError reports the messages of a batch that could not be sent
+type BatchError struct {
+	// Errors holds the error of every failed message by its index in the batch
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	messages := make([]string, len(indexes))
+	for n, i := range indexes {
+		messages[n] = fmt.Sprintf("#%d: %s", i, e.Errors[i])
+	}
+	return fmt.Sprintf("%d messages could not be sent: %s", len(indexes), strings.Join(messages, ", "))
+}
+
+// PublisherOption customizes a Publisher
+type PublisherOption interface {
+	applyPublisher(o *publisherOptions)
+}
+
+type publisherOptions struct {
+	clock clock.Clock
+}
+
+func newPublisherOptions(opts []PublisherOption) publisherOptions {
+	o := publisherOptions{
+		clock: clock.New(),
+	}
+
+	for _, opt := range opts {
+		opt.applyPublisher(&o)
+	}
+
+	return o
+}
+
+// NewPublisher creates a default Publisher implementation
+func NewPublisher(url string, logger log.FieldLogger, metrics metrics.Client, opts ...PublisherOption) (Publisher, error) {
+	session, err := session.NewSession(&aws.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &publisher{
+		url:              url,
+		service:          sqs.New(session),
+		logger:           logger,
+		metrics:          metrics,
+		publisherOptions: newPublisherOptions(opts),
+	}, nil
+}
+
+type publisher struct {
+	url     string
+	service sqsiface.SQSAPI
+	logger  log.FieldLogger
+	metrics metrics.Client
+	publisherOptions
+}
+
+func (p *publisher) Send(ctx context.Context, m *OutgoingMessage) (string, error) {
+	p.metrics.Incr(QueuePublishTried)
+	start := p.clock.Now()
+
+	output, err := p.service.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:               aws.String(p.url),
+		MessageBody:            aws.String(m.Body),
+		DelaySeconds:           delaySeconds(m.Delay),
+		MessageAttributes:      toSQSAttributes(m.Attributes),
+		MessageGroupId:         optionalString(m.MessageGroupID),
+		MessageDeduplicationId: optionalString(m.MessageDeduplicationID),
+	})
+	p.metrics.Timing(QueuePublishTime, start)
+
+	if err != nil {
+		p.logger.WithError(err).Error("Could not send message")
+		p.metrics.Incr(QueuePublishErr)
+		return "", err
+	}
+
+	p.metrics.Incr(QueuePublishOk)
+	p.logger.WithField("message_id", aws.StringValue(output.MessageId)).Debug("Message sent")
+	return aws.StringValue(output.MessageId), nil
+}
+
+func (p *publisher) SendBatch(ctx context.Context, messages []*OutgoingMessage) ([]string, error) {
+	ids := make([]string, len(messages))
+	batchErr := &BatchError{Errors: map[int]error{}}
+
+	for offset := 0; offset < len(messages); offset += MaxBatchSize {
+		end := offset + MaxBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		p.sendBatch(ctx, messages[offset:end], offset, ids, batchErr)
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return ids, batchErr
+	}
+	return ids, nil
+}
+
+// sendBatch sends a single SendMessageBatch request. offset is the index of the first message in the whole batch
+func (p *publisher) sendBatch(ctx context.Context, messages []*OutgoingMessage, offset int, ids []string, batchErr *BatchError) {
+	start := p.clock.Now()
+
+	entries := make([]*sqs.SendMessageBatchRequestEntry, len(messages))
+	for i, m := range messages {
+		// like ok and error, tried is counted per message
+		p.metrics.Incr(QueuePublishTried)
+		entries[i] = &sqs.SendMessageBatchRequestEntry{
+			// entry ids are the indexes in the whole batch
+			Id:                     aws.String(strconv.Itoa(offset + i)),
+			MessageBody:            aws.String(m.Body),
+			DelaySeconds:           delaySeconds(m.Delay),
+			MessageAttributes:      toSQSAttributes(m.Attributes),
+			MessageGroupId:         optionalString(m.MessageGroupID),
+			MessageDeduplicationId: optionalString(m.MessageDeduplicationID),
+		}
+	}
+
+	output, err := p.service.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(p.url),
+		Entries:  entries,
+	})
+	p.metrics.Timing(QueuePublishTime, start)
+
+	if err != nil {
+		p.logger.WithError(err).Error("Could not send messages")
+		for i := range messages {
+			p.metrics.Incr(QueuePublishErr)
+			batchErr.Errors[offset+i] = err
+		}
+		return
+	}
+
+	for _, sent := range output.Successful {
+		i, err := strconv.Atoi(aws.StringValue(sent.Id))
+		if err != nil || i < offset || i >= offset+len(messages) {
+			continue
+		}
+		p.metrics.Incr(QueuePublishOk)
+		ids[i] = aws.StringValue(sent.MessageId)
+	}
+
+	for _, failed := range output.Failed {
+		i, err := strconv.Atoi(aws.StringValue(failed.Id))
+		if err != nil || i < offset || i >= offset+len(messages) {
+			continue
+		}
+		p.metrics.Incr(QueuePublishErr)
+		err = fmt.Errorf("%s: %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+		p.logger.WithError(err).Error("Could not send message")
+		batchErr.Errors[i] = err
+	}
+}
+
+// delaySeconds converts a delivery delay. It returns nil when there is no delay
+func delaySeconds(d time.Duration) *int64 {
+	if d <= 0 {
+		return nil
+	}
+	if d > MaxDelay {
+		d = MaxDelay
+	}
+	return aws.Int64(int64(d / time.Second))
+}
+
+// optionalString returns nil for empty strings
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
@@ -0,0 +1,195 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublisherSendsMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &mockPublishClient{}
+	p := newTestPublisher(service)
+
+	m, err := JSONMessage(map[string]string{"foo": "bar"})
+	assert.Nil(err)
+	m.Delay = time.Hour
+	m.Attributes = map[string]MessageAttribute{"trace_id": StringAttribute("abc")}
+	m.MessageGroupID = "group"
+
+	id, err := p.Send(context.Background(), m)
+	assert.Nil(err)
+	assert.Equal("id-0", id)
+
+	input := service.sent[0]
+	assert.Equal("test-url", *input.QueueUrl)
+	assert.Equal(`{"foo":"bar"}`, *input.MessageBody)
+	// the delay is capped
+	assert.Equal(int64(900), *input.DelaySeconds)
+	assert.Equal("abc", *input.MessageAttributes["trace_id"].StringValue)
+	assert.Equal("group", *input.MessageGroupId)
+	assert.Nil(input.MessageDeduplicationId)
+}
+
+func TestPublisherReportsSendErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &mockPublishClient{err: errors.New("unavailable")}
+	recorder := metrics.NewRecorder(clock.New())
+	p := newTestPublisher(service)
+	p.metrics = recorder
+
+	_, err := p.Send(context.Background(), &OutgoingMessage{Body: "foo"})
+	assert.Equal("unavailable", err.Error())
+	assert.Equal([]string{"queue.publish.tried []", "queue.publish.time []", "queue.publish.error []"}, recorder.Calls())
+}
+
+func TestPublisherSendsBatchesOfTenMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &mockPublishClient{}
+	p := newTestPublisher(service)
+
+	var messages []*OutgoingMessage
+	for i := 0; i < 23; i++ {
+		messages = append(messages, &OutgoingMessage{Body: fmt.Sprintf("message #%d", i)})
+	}
+
+	ids, err := p.SendBatch(context.Background(), messages)
+	assert.Nil(err)
+	assert.Len(ids, 23)
+	assert.Equal("id-0", ids[0])
+	assert.Equal("id-22", ids[22])
+
+	assert.Len(service.batches, 3)
+	assert.Len(service.batches[0].Entries, 10)
+	assert.Len(service.batches[1].Entries, 10)
+	assert.Len(service.batches[2].Entries, 3)
+	assert.Equal("message #20", *service.batches[2].Entries[0].MessageBody)
+}
+
+func TestPublisherReportsPartialBatchFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &mockPublishClient{failures: map[string]bool{"message #1": true, "message #11": true}}
+	recorder := metrics.NewRecorder(clock.New())
+	p := newTestPublisher(service)
+	p.metrics = recorder
+
+	var messages []*OutgoingMessage
+	for i := 0; i < 12; i++ {
+		messages = append(messages, &OutgoingMessage{Body: fmt.Sprintf("message #%d", i)})
+	}
+
+	ids, err := p.SendBatch(context.Background(), messages)
+	batchErr, ok := err.(*BatchError)
+	assert.True(ok)
+	assert.Len(batchErr.Errors, 2)
+	assert.Equal("InternalError: could not send message", batchErr.Errors[11].Error())
+	assert.Equal("2 messages could not be sent: #1: InternalError: could not send message, #11: InternalError: could not send message", err.Error())
+
+	assert.Equal("id-0", ids[0])
+	assert.Equal("", ids[1])
+	assert.Equal("id-10", ids[10])
+	assert.Equal("", ids[11])
+
+	counts := map[string]int{}
+	for _, call := range recorder.Calls() {
+		counts[call]++
+	}
+	assert.Equal(12, counts["queue.publish.tried []"])
+	assert.Equal(10, counts["queue.publish.ok []"])
+	assert.Equal(2, counts["queue.publish.error []"])
+}
+
+func TestMemoryPublisher(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewMemoryPublisher()
+
+	id, err := p.Send(context.Background(), &OutgoingMessage{Body: "foo"})
+	assert.Nil(err)
+	assert.Equal("0", id)
+
+	ids, err := p.SendBatch(context.Background(), []*OutgoingMessage{{Body: "bar"}, {Body: "baz"}})
+	assert.Nil(err)
+	assert.Equal([]string{"1", "2"}, ids)
+
+	assert.Len(p.Messages(), 3)
+	assert.Equal("baz", p.Messages()[2].Body)
+
+	p.Err = errors.New("unavailable")
+	_, err = p.SendBatch(context.Background(), []*OutgoingMessage{{Body: "qux"}})
+	assert.IsType(&BatchError{}, err)
+
+	p.Reset()
+	assert.Empty(p.Messages())
+}
+
+// newTestPublisher creates a publisher sending messages to a mock service
+func newTestPublisher(service sqsiface.SQSAPI, opts ...PublisherOption) *publisher {
+	return &publisher{
+		url:              "test-url",
+		service:          service,
+		logger:           logrus.StandardLogger(),
+		metrics:          metrics.Default,
+		publisherOptions: newPublisherOptions(opts),
+	}
+}
+
+// Mock implementation of SQS used to test publishers
+type mockPublishClient struct {
+	sqsiface.SQSAPI
+	sent    []*sqs.SendMessageInput
+	batches []*sqs.SendMessageBatchInput
+	err     error
+	// failures makes the messages with these bodies fail in batches
+	failures map[string]bool
+}
+
+func (c *mockPublishClient) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.sent = append(c.sent, input)
+	return &sqs.SendMessageOutput{MessageId: aws.String(fmt.Sprintf("id-%d", len(c.sent)-1))}, nil
+}
+
+func (c *mockPublishClient) SendMessageBatchWithContext(ctx aws.Context, input *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.batches = append(c.batches, input)
+
+	output := &sqs.SendMessageBatchOutput{}
+	for _, entry := range input.Entries {
+		if c.failures[*entry.MessageBody] {
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String("InternalError"),
+				Message:     aws.String("could not send message"),
+				SenderFault: aws.Bool(false),
+			})
+			continue
+		}
+		i, _ := strconv.Atoi(*entry.Id)
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{
+			Id:        entry.Id,
+			MessageId: aws.String(fmt.Sprintf("id-%d", i)),
+		})
+	}
+	return output, nil
+}
@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -8,7 +9,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/fchoquet/golibs/clock"
 	"github.com/fchoquet/golibs/metrics"
+	"github.com/fchoquet/golibs/retry"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -21,21 +24,12 @@ var (
 	QueueAckOk              = "queue.ack.ok"
 	QueueAckErr             = "queue.ack.error"
 	QueueAckTime            = "queue.ack.time"
+	QueueAckBatchSize       = "queue.ack.batch_size"
+	QueueAckPartialFailure  = "queue.ack.partial_failure"
+	QueueVisibilityOk       = "queue.visibility.ok"
+	QueueVisibilityErr      = "queue.visibility.error"
 )
 
-// Message reprensents a queue message
-type Message struct {
-	MessageID     string `json:"message_id"`
-	Body          string `json:"body"`
-	ReceiptHandle string `json:"receipt_handle"`
-	ack           chan<- *Message
-}
-
-// Ack acknowledges the message
-func (m *Message) Ack() {
-	m.ack <- m
-}
-
 // Listener listens for messages in the queue and sends them to a channel
 // Errors are sent to a separate channel
 type Listener interface {
@@ -43,21 +37,198 @@ type Listener interface {
 	Listen() (<-chan *Message, <-chan error)
 	// LastRequest returns the duration since the last request to the server
 	LastRequest() *time.Duration
+	// Stop stops listening and closes the message and error channels.
+	// It then waits for the messages already received to be acknowledged or released, and for the acknowledgements to be processed.
+	// Use a context with a timeout to limit the wait. The context error is returned if the messages were not all acknowledged
+	Stop(ctx context.Context) error
+}
+
+// MaxWaitTime is the longest time a receive request can wait for messages
+const MaxWaitTime = 20 * time.Second
+
+// ListenerOption customizes a Listener
+type ListenerOption interface {
+	applyListener(o *listenerOptions)
+}
+
+// CommonOption customizes a Listener, a Worker, a Publisher or a Router
+type CommonOption interface {
+	ListenerOption
+	WorkerOption
+	PublisherOption
+	RouterOption
+}
+
+type listenerOption func(o *listenerOptions)
+
+func (f listenerOption) applyListener(o *listenerOptions) {
+	f(o)
+}
+
+type listenerOptions struct {
+	clock clock.Clock
+	// acks are sent by batches of ackBatchSize, at least every ackInterval
+	ackBatchSize int
+	ackInterval  time.Duration
+	// heartbeatInterval is zero when heartbeats are disabled
+	heartbeatInterval  time.Duration
+	heartbeatExtension time.Duration
+	// polling options. visibilityTimeout is zero to use the queue setting, maxInFlight to disable the limit
+	maxMessages       int
+	waitTime          time.Duration
+	visibilityTimeout time.Duration
+	maxInFlight       int
+	pollers           int
+	idleBackoff       retry.BackOffFunc
+}
+
+func newListenerOptions(opts []ListenerOption) listenerOptions {
+	o := listenerOptions{
+		clock:        clock.New(),
+		ackBatchSize: MaxBatchSize,
+		ackInterval:  1 * time.Second,
+		maxMessages:  MaxBatchSize,
+		waitTime:     MaxWaitTime,
+		pollers:      1,
+		idleBackoff:  retry.Constant(1 * time.Second),
+	}
+
+	for _, opt := range opts {
+		opt.applyListener(&o)
+	}
+
+	return o
+}
+
+// WithClock sets the clock used to measure and wait. Use a fake clock in tests
+func WithClock(c clock.Clock) CommonOption {
+	return clockOption{clock: c}
+}
+
+type clockOption struct {
+	clock clock.Clock
+}
+
+func (c clockOption) applyListener(o *listenerOptions) {
+	o.clock = c.clock
+}
+
+func (c clockOption) applyWorker(o *workerOptions) {
+	o.clock = c.clock
+}
+
+func (c clockOption) applyPublisher(o *publisherOptions) {
+	o.clock = c.clock
+}
+
+func (c clockOption) applyRouter(r *Router) {
+	r.clock = c.clock
+}
+
+// AckBatch sets how acknowledgements are buffered before being sent with a single request
+// A batch is sent when it reaches size, capped to MaxBatchSize, or when its oldest ack has waited for interval
+// Default is MaxBatchSize acks and 1 second
+func AckBatch(size int, interval time.Duration) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		if size < 1 {
+			size = 1
+		}
+		if size > MaxBatchSize {
+			size = MaxBatchSize
+		}
+		o.ackBatchSize = size
+		o.ackInterval = interval
+	})
+}
+
+// Heartbeat extends the visibility timeout of the received messages to extension every interval,
+// until they are acknowledged or released. Use it when messages may take longer to process than the visibility timeout
+// interval must be shorter than extension to leave room for network delays
+func Heartbeat(interval, extension time.Duration) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		o.heartbeatInterval = interval
+		o.heartbeatExtension = extension
+	})
+}
+
+// MaxMessages sets the maximum number of messages received by a single request, between 1 and MaxBatchSize
+// Default is MaxBatchSize
+func MaxMessages(n int) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		if n < 1 {
+			n = 1
+		}
+		if n > MaxBatchSize {
+			n = MaxBatchSize
+		}
+		o.maxMessages = n
+	})
+}
+
+// WaitTime sets how long a receive request waits for messages (long polling), up to MaxWaitTime
+// Default is MaxWaitTime
+func WaitTime(d time.Duration) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		if d < 0 {
+			d = 0
+		}
+		if d > MaxWaitTime {
+			d = MaxWaitTime
+		}
+		o.waitTime = d
+	})
+}
+
+// VisibilityTimeout sets the visibility timeout of the received messages, overriding the queue setting
+func VisibilityTimeout(d time.Duration) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		if d > MaxVisibilityTimeout {
+			d = MaxVisibilityTimeout
+		}
+		o.visibilityTimeout = d
+	})
+}
+
+// MaxInFlight limits the number of messages received but not acknowledged or released yet
+// Polling pauses when the limit is reached, until handlers catch up. Zero means no limit, which is the default
+func MaxInFlight(n int) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		o.maxInFlight = n
+	})
+}
+
+// Pollers sets the number of concurrent receive loops. Use more than one for high-throughput queues. Default is 1
+func Pollers(n int) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		if n < 1 {
+			n = 1
+		}
+		o.pollers = n
+	})
+}
+
+// IdleBackoff sets the wait between receive requests when the queue is empty or the requests fail
+// backoff is called with the number of consecutive empty or failed requests. Default is 1 second
+func IdleBackoff(backoff retry.BackOffFunc) ListenerOption {
+	return listenerOption(func(o *listenerOptions) {
+		o.idleBackoff = backoff
+	})
 }
 
 // New creates a new default Listener implementation
-func New(url string, logger log.FieldLogger, metrics metrics.Client) (Listener, error) {
+func New(url string, logger log.FieldLogger, metrics metrics.Client, opts ...ListenerOption) (Listener, error) {
 	session, err := session.NewSession(&aws.Config{})
 	if err != nil {
 		return nil, err
 	}
 
 	return &queue{
-		url:     url,
-		service: sqs.New(session),
-		mutex:   &sync.Mutex{},
-		logger:  logger,
-		metrics: metrics,
+		url:             url,
+		service:         sqs.New(session),
+		mutex:           &sync.Mutex{},
+		logger:          logger,
+		metrics:         metrics,
+		listenerOptions: newListenerOptions(opts),
 	}, nil
 }
 
@@ -68,22 +239,184 @@ type queue struct {
 	mutex       *sync.Mutex
 	logger      log.FieldLogger
 	metrics     metrics.Client
+	listenerOptions
+
+	// cancel stops polling and done is closed once the poller has returned
+	cancel context.CancelFunc
+	done   chan struct{}
+	// inFlight counts the messages received but not acknowledged yet
+	inFlight sync.WaitGroup
+	// slots holds a value for every message in flight when their number is limited
+	slots chan struct{}
+	// acks is closed on shutdown, once the buffered acks are flushed. Later acks are processed synchronously
+	acks       chan *Message
+	acksClosed bool
+	acksMutex  sync.RWMutex
+	acksDone   chan struct{}
+	stopOnce   sync.Once
+	stopErr    error
 }
 
 func (q *queue) Listen() (<-chan *Message, <-chan error) {
 	c := make(chan *Message)
-	ack := make(chan *Message)
 	e := make(chan error)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	q.done = make(chan struct{})
+	q.acks = make(chan *Message)
+	q.acksDone = make(chan struct{})
+
+	if q.maxInFlight > 0 {
+		q.slots = make(chan struct{}, q.maxInFlight)
+	}
+
 	// listen to queue messages and pushes them to c. Errors are pushed to e
-	go listen(q, c, e, ack)
+	pollers := sync.WaitGroup{}
+	for i := 0; i < q.pollers; i++ {
+		pollers.Add(1)
+		go func() {
+			defer pollers.Done()
+			listen(ctx, q, c, e)
+		}()
+	}
+	go func() {
+		pollers.Wait()
+		close(c)
+		close(e)
+		close(q.done)
+	}()
 
 	// listen to acknowledgement messages and processes them
-	go listenAck(q, ack)
+	go func() {
+		listenAck(q, q.acks)
+		close(q.acksDone)
+	}()
 
 	return c, e
 }
 
+func (q *queue) Stop(ctx context.Context) error {
+	q.stopOnce.Do(func() {
+		if q.cancel == nil {
+			// not listening
+			return
+		}
+
+		q.cancel()
+		q.stopErr = q.drain(ctx)
+		if q.stopErr != nil {
+			q.logger.WithError(q.stopErr).Warn("Stopping before all the messages were acknowledged")
+		}
+
+		// flush pending acks
+		q.acksMutex.Lock()
+		q.acksClosed = true
+		close(q.acks)
+		q.acksMutex.Unlock()
+		<-q.acksDone
+	})
+
+	return q.stopErr
+}
+
+// drain waits for the poller to return and for the messages in flight to be acknowledged
+func (q *queue) drain(ctx context.Context) error {
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		q.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *queue) ack(m *Message) {
+	defer q.settled()
+
+	q.acksMutex.RLock()
+	defer q.acksMutex.RUnlock()
+
+	if q.acksClosed {
+		flushAcks(q, []pendingAck{{msg: m}})
+		return
+	}
+	q.acks <- m
+}
+
+func (q *queue) release(m *Message) {
+	q.settled()
+}
+
+// settled is called when a message in flight has been acknowledged or released
+func (q *queue) settled() {
+	q.releaseSlots(1)
+	q.inFlight.Done()
+}
+
+// acquireSlots reserves slots for the messages to receive, waiting for at least one to be available
+// It returns the number of messages to receive, or false if ctx is done while waiting
+func (q *queue) acquireSlots(ctx context.Context) (int, bool) {
+	if q.slots == nil {
+		return q.maxMessages, true
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0, false
+	}
+
+	n := 1
+	for n < q.maxMessages {
+		select {
+		case q.slots <- struct{}{}:
+			n++
+		default:
+			return n, true
+		}
+	}
+	return n, true
+}
+
+// releaseSlots gives n slots back
+func (q *queue) releaseSlots(n int) {
+	if q.slots == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-q.slots
+	}
+}
+
+func (q *queue) changeVisibility(m *Message, d time.Duration) error {
+	_, err := q.service.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &q.url,
+		ReceiptHandle:     &m.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(int64(d / time.Second)),
+	})
+
+	if err != nil {
+		q.logger.WithError(err).WithField("message_id", m.MessageID).Error("Could not change message visibility")
+		q.metrics.Incr(QueueVisibilityErr)
+		return err
+	}
+
+	q.metrics.Incr(QueueVisibilityOk)
+	return nil
+}
+
 func (q *queue) LastRequest() *time.Duration {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -91,73 +424,138 @@ func (q *queue) LastRequest() *time.Duration {
 	if q.lastRequest == nil {
 		return nil
 	}
-	duration := time.Since(*q.lastRequest)
+	duration := q.clock.Since(*q.lastRequest)
 	return &duration
 }
 
 func (q *queue) updateLastRequest() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	now := time.Now()
+	now := q.clock.Now()
 	q.lastRequest = &now
 }
 
-func listen(q *queue, c chan *Message, e chan error, ack chan *Message) {
-	for {
-		start := time.Now()
+func listen(ctx context.Context, q *queue, c chan<- *Message, e chan<- error) {
+	// idle counts the consecutive empty or failed receive requests
+	idle := 0
 
-		output, err := q.service.ReceiveMessage(&sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(q.url),
-			MaxNumberOfMessages: aws.Int64(10),
-			WaitTimeSeconds:     aws.Int64(20),
-		})
+	for ctx.Err() == nil {
+		n, ok := q.acquireSlots(ctx)
+		if !ok {
+			return
+		}
+
+		start := q.clock.Now()
+
+		input := &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(q.url),
+			MaxNumberOfMessages:   aws.Int64(int64(n)),
+			WaitTimeSeconds:       aws.Int64(int64(q.waitTime / time.Second)),
+			AttributeNames:        aws.StringSlice(systemAttributes),
+			MessageAttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameAll}),
+		}
+		if q.visibilityTimeout > 0 {
+			input.VisibilityTimeout = aws.Int64(int64(q.visibilityTimeout / time.Second))
+		}
+
+		output, err := q.service.ReceiveMessageWithContext(ctx, input)
+		if ctx.Err() != nil {
+			// the listener is stopping, the request was cancelled
+			q.releaseSlots(n)
+			return
+		}
 		q.metrics.Incr(QueueMessageReceived)
 		q.metrics.Timing(QueueReceiveMessageTime, start)
 		if err != nil {
+			q.releaseSlots(n)
 			q.logger.WithError(err).Error("Could not receive message")
 			metrics.Incr(QueueError)
-			e <- err
+			select {
+			case e <- err:
+			case <-ctx.Done():
+			}
+			idle++
+			q.idleWait(ctx, idle)
 			continue
 		}
 		// The service is doing its job, so let's say it
 		q.updateLastRequest()
 
+		// the slots of the messages not received are not needed
+		q.releaseSlots(n - len(output.Messages))
+
 		for _, msg := range output.Messages {
 			q.logger.WithField("body", *msg.Body).Debug("Message body")
 
-			c <- &Message{
-				MessageID:     *msg.MessageId,
-				Body:          *msg.Body,
-				ReceiptHandle: *msg.ReceiptHandle,
-				ack:           ack,
+			m := newMessage(q, msg)
+			if q.heartbeatInterval > 0 {
+				m.heartbeat = startHeartbeat(q, m)
+			}
+
+			q.inFlight.Add(1)
+			select {
+			case c <- m:
+			case <-ctx.Done():
+				// the message will be received again once its visibility timeout expires
+				m.Release()
 			}
 		}
 
 		if len(output.Messages) == 0 {
-			time.Sleep(1 * time.Second)
+			idle++
+			q.idleWait(ctx, idle)
+			continue
 		}
+		idle = 0
 	}
 }
 
-func listenAck(q *queue, ack <-chan *Message) {
-	for msg := range ack {
-		q.metrics.Incr(QueueAckTried)
-		start := time.Now()
+// idleWait waits before the next receive request after idle consecutive empty or failed requests
+func (q *queue) idleWait(ctx context.Context, idle int) {
+	select {
+	case <-q.clock.After(q.idleBackoff(idle)):
+	case <-ctx.Done():
+	}
+}
 
-		_, err := q.service.DeleteMessage(&sqs.DeleteMessageInput{
-			QueueUrl:      &q.url,
-			ReceiptHandle: &msg.ReceiptHandle,
-		})
+// newMessage converts a message received from SQS
+func newMessage(q *queue, msg *sqs.Message) *Message {
+	return &Message{
+		MessageID:              aws.StringValue(msg.MessageId),
+		Body:                   aws.StringValue(msg.Body),
+		ReceiptHandle:          aws.StringValue(msg.ReceiptHandle),
+		Attributes:             fromSQSAttributes(msg.MessageAttributes),
+		ReceiveCount:           receiveCount(msg),
+		SentTimestamp:          sentTimestamp(msg),
+		MessageGroupID:         aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]),
+		MessageDeduplicationID: aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId]),
+		acker:                  q,
+	}
+}
 
-		if err != nil {
-			q.logger.WithError(err).Error("Could not delete message")
-			q.metrics.Incr(QueueAckErr)
-			// There's not much we can do here. Message is already processed and we can't rollback
-			// We'll get a duplicate
-			// This is unlikely to happen so let's only monitor it for now and see if an action is needed
+// startHeartbeat periodically extends the visibility of m until the heartbeat is stopped
+func startHeartbeat(q *queue, m *Message) *heartbeat {
+	h := &heartbeat{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(h.done)
+
+		ticker := q.clock.NewTicker(q.heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				// errors are already logged. Let's keep trying, the next extension may succeed
+				q.changeVisibility(m, q.heartbeatExtension)
+			case <-h.stop:
+				return
+			}
 		}
+	}()
 
-		q.metrics.Incr(QueueAckOk)
-		q.metrics.Timing(QueueAckTime, start)
-	}
+	return h
 }
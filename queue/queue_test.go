@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -8,9 +9,12 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/fchoquet/golibs/clock"
 	"github.com/fchoquet/golibs/metrics"
+	"github.com/fchoquet/golibs/retry"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -33,13 +37,7 @@ func TestItListensToMessages(t *testing.T) {
 		},
 	}
 
-	q := queue{
-		url:     "test-url",
-		service: &service,
-		mutex:   &sync.Mutex{},
-		logger:  logrus.StandardLogger(),
-		metrics: metrics.Default,
-	}
+	q := newTestQueue(&service)
 
 	c, _ := q.Listen()
 
@@ -57,13 +55,7 @@ func TestItListensToMessages(t *testing.T) {
 func TestItReportsErrors(t *testing.T) {
 	assert := assert.New(t)
 
-	q := queue{
-		url:     "test-url",
-		service: &mockSQSClient{},
-		mutex:   &sync.Mutex{},
-		logger:  logrus.StandardLogger(),
-		metrics: metrics.Default,
-	}
+	q := newTestQueue(&mockSQSClient{})
 
 	// mockSQSClient triggers an error when it have no messages left to create
 	// we need an error, so let's use this one
@@ -89,13 +81,7 @@ func TestItDeletesAcknowledgedMessages(t *testing.T) {
 		mutex: mutex,
 	}
 
-	q := queue{
-		url:     "test-url",
-		service: &service,
-		mutex:   &sync.Mutex{},
-		logger:  logrus.StandardLogger(),
-		metrics: metrics.Default,
-	}
+	q := newTestQueue(&service)
 
 	c, _ := q.Listen()
 
@@ -106,8 +92,8 @@ func TestItDeletesAcknowledgedMessages(t *testing.T) {
 
 	msg.Ack()
 
-	// Let's wait for the Ack to really happen
-	time.Sleep(1 * time.Millisecond)
+	// Stop flushes the buffered acks
+	assert.Nil(q.Stop(context.Background()))
 
 	// we need a mutex to protect access to service.deletedMessages
 	mutex.Lock()
@@ -134,13 +120,7 @@ func TestItKeepsTrackOfLastRequest(t *testing.T) {
 		},
 	}
 
-	q := queue{
-		url:     "test-url",
-		service: &service,
-		mutex:   &sync.Mutex{},
-		logger:  logrus.StandardLogger(),
-		metrics: metrics.Default,
-	}
+	q := newTestQueue(&service)
 
 	// No previous request
 	assert.Nil(q.LastRequest())
@@ -155,16 +135,366 @@ func TestItKeepsTrackOfLastRequest(t *testing.T) {
 	assert.NotNil(q.LastRequest())
 }
 
+func TestLastRequestUsesTheClock(t *testing.T) {
+	assert := assert.New(t)
+
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+			},
+		},
+	}
+
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	q := newTestQueue(&service, WithClock(c))
+
+	ch, _ := q.Listen()
+	<-ch
+
+	c.Advance(5 * time.Second)
+	assert.Equal(5*time.Second, *q.LastRequest())
+}
+
+func TestStopClosesTheChannels(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newTestQueue(&mockSQSClient{})
+
+	c, e := q.Listen()
+
+	assert.Nil(q.Stop(context.Background()))
+
+	_, ok := <-c
+	assert.False(ok)
+	_, ok = <-e
+	assert.False(ok)
+
+	// stopping twice is harmless
+	assert.Nil(q.Stop(context.Background()))
+}
+
+func TestStopWaitsForAcknowledgements(t *testing.T) {
+	assert := assert.New(t)
+
+	mutex := &sync.Mutex{}
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+			},
+		},
+		mutex: mutex,
+	}
+
+	q := newTestQueue(&service)
+
+	c, _ := q.Listen()
+	msg := <-c
+
+	ctx := newStoppingContext()
+	go func() {
+		<-ctx.stopping
+		msg.Ack()
+		// acknowledging twice is harmless
+		msg.Ack()
+	}()
+
+	assert.Nil(q.Stop(ctx))
+
+	// the ack was processed before Stop returned
+	mutex.Lock()
+	assert.Equal(1, len(service.deletedMessages))
+	mutex.Unlock()
+}
+
+func TestStopGivesUpWhenTheContextIsDone(t *testing.T) {
+	assert := assert.New(t)
+
+	mutex := &sync.Mutex{}
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+			},
+		},
+		mutex: mutex,
+	}
+
+	q := newTestQueue(&service)
+
+	c, _ := q.Listen()
+	msg := <-c
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, q.Stop(ctx))
+
+	// late acks are still processed
+	msg.Ack()
+	mutex.Lock()
+	assert.Equal(1, len(service.deletedMessages))
+	mutex.Unlock()
+}
+
+func TestItChangesMessageVisibility(t *testing.T) {
+	assert := assert.New(t)
+
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+			},
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	q := newTestQueue(&service)
+
+	c, _ := q.Listen()
+	msg := <-c
+
+	assert.Nil(msg.ChangeVisibility(2 * time.Minute))
+	assert.Equal([]string{"receipt-handle-0:120"}, service.changedVisibilities())
+}
+
+func TestHeartbeatExtendsVisibilityUntilAck(t *testing.T) {
+	assert := assert.New(t)
+
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+			},
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	clk := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	q := newTestQueue(&service, WithClock(clk), Heartbeat(20*time.Second, time.Minute))
+
+	c, _ := q.Listen()
+	msg := <-c
+
+	for i := 1; i <= 2; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(20 * time.Second)
+		n := i
+		assert.Eventually(func() bool {
+			return len(service.changedVisibilities()) == n
+		}, time.Second, time.Millisecond)
+	}
+	assert.Equal([]string{"receipt-handle-0:60", "receipt-handle-0:60"}, service.changedVisibilities())
+
+	// the heartbeat stops as soon as the message is acknowledged
+	msg.Ack()
+	clk.Advance(time.Minute)
+	assert.Nil(q.Stop(context.Background()))
+	assert.Len(service.changedVisibilities(), 2)
+}
+
+func TestNackMakesTheMessageVisibleAgain(t *testing.T) {
+	assert := assert.New(t)
+
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+			},
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	q := newTestQueue(&service)
+
+	c, _ := q.Listen()
+	msg := <-c
+
+	msg.Nack()
+	// the message is settled, acknowledging it is a no-op
+	msg.Ack()
+
+	assert.Equal([]string{"receipt-handle-0:0"}, service.changedVisibilities())
+	assert.Nil(q.Stop(context.Background()))
+	assert.Empty(service.deletedMessages)
+}
+
+func TestRequeueWithBackoffUsesTheReceiveCount(t *testing.T) {
+	assert := assert.New(t)
+
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+				Attributes: map[string]*string{
+					sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3"),
+				},
+			},
+			{
+				Body:          aws.String("this is message #1"),
+				ReceiptHandle: aws.String("receipt-handle-1"),
+				MessageId:     aws.String("message-id-1"),
+			},
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	q := newTestQueue(&service)
+
+	c, _ := q.Listen()
+	backoff := retry.Linear(10*time.Second, time.Hour)
+
+	msg := <-c
+	assert.Equal(3, msg.ReceiveCount)
+	msg.RequeueWithBackoff(backoff)
+
+	// unknown receive counts are considered as a first receive
+	msg = <-c
+	assert.Equal(0, msg.ReceiveCount)
+	msg.RequeueWithBackoff(backoff)
+
+	assert.Equal([]string{"receipt-handle-0:30", "receipt-handle-1:10"}, service.changedVisibilities())
+}
+
+func TestRequeueAfterIsCapped(t *testing.T) {
+	assert := assert.New(t)
+
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+			},
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	q := newTestQueue(&service)
+
+	c, _ := q.Listen()
+	msg := <-c
+
+	msg.RequeueAfter(24 * time.Hour)
+	assert.Equal([]string{"receipt-handle-0:43200"}, service.changedVisibilities())
+}
+
+func TestItExposesMessageAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	service := mockSQSClient{
+		messages: []*sqs.Message{
+			{
+				Body:          aws.String("this is message #0"),
+				ReceiptHandle: aws.String("receipt-handle-0"),
+				MessageId:     aws.String("message-id-0"),
+				Attributes: map[string]*string{
+					sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("2"),
+					sqs.MessageSystemAttributeNameSentTimestamp:           aws.String("1525176000123"),
+					sqs.MessageSystemAttributeNameMessageGroupId:          aws.String("group"),
+					sqs.MessageSystemAttributeNameMessageDeduplicationId:  aws.String("dedup"),
+				},
+				MessageAttributes: map[string]*sqs.MessageAttributeValue{
+					"trace_id": {DataType: aws.String("String"), StringValue: aws.String("abc")},
+					"priority": {DataType: aws.String("Number.int"), StringValue: aws.String("3")},
+					"payload":  {DataType: aws.String("Binary"), BinaryValue: []byte{1, 2}},
+				},
+			},
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	q := newTestQueue(&service)
+
+	c, _ := q.Listen()
+	msg := <-c
+
+	assert.Equal(2, msg.ReceiveCount)
+	assert.True(time.Date(2018, 5, 1, 12, 0, 0, 123000000, time.UTC).Equal(msg.SentTimestamp))
+	assert.Equal("group", msg.MessageGroupID)
+	assert.Equal("dedup", msg.MessageDeduplicationID)
+	assert.Equal(map[string]MessageAttribute{
+		"trace_id": StringAttribute("abc"),
+		"priority": {DataType: "Number.int", StringValue: "3"},
+		"payload":  BinaryAttribute([]byte{1, 2}),
+	}, msg.Attributes)
+
+	msg.Ack()
+	assert.Nil(q.Stop(context.Background()))
+
+	// all the attributes were requested
+	assert.ElementsMatch([]string{"ApproximateReceiveCount", "SentTimestamp", "MessageGroupId", "MessageDeduplicationId"}, aws.StringValueSlice(service.input.AttributeNames))
+	assert.Equal([]string{"All"}, aws.StringValueSlice(service.input.MessageAttributeNames))
+}
+
+// newTestQueue creates a queue listening to a mock service
+// stoppingContext is a context closing stopping as soon as Stop waits on it
+// It lets tests act while Stop is in progress without sleeping
+type stoppingContext struct {
+	context.Context
+	once     sync.Once
+	stopping chan struct{}
+}
+
+func newStoppingContext() *stoppingContext {
+	return &stoppingContext{
+		Context:  context.Background(),
+		stopping: make(chan struct{}),
+	}
+}
+
+func (c *stoppingContext) Done() <-chan struct{} {
+	c.once.Do(func() {
+		close(c.stopping)
+	})
+	return c.Context.Done()
+}
+
+func newTestQueue(service sqsiface.SQSAPI, opts ...ListenerOption) *queue {
+	return &queue{
+		url:             "test-url",
+		service:         service,
+		mutex:           &sync.Mutex{},
+		logger:          logrus.StandardLogger(),
+		metrics:         metrics.Default,
+		listenerOptions: newListenerOptions(opts),
+	}
+}
+
 // Mock implementation of SQS used for these tests
 type mockSQSClient struct {
 	sqsiface.SQSAPI
 	messages        []*sqs.Message
 	index           int
 	deletedMessages []*sqs.Message
+	visibilities    []string
 	mutex           *sync.Mutex
+	// input is the last ReceiveMessage input
+	input *sqs.ReceiveMessageInput
+	// batches holds the size of every DeleteMessageBatch request
+	batches []int
+	// batchErr makes DeleteMessageBatch fail
+	batchErr error
+	// failures makes DeleteMessageBatch fail for some receipt handles. The value is the sender fault flag
+	failures map[string]bool
 }
 
-func (c *mockSQSClient) ReceiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+func (c *mockSQSClient) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	c.input = input
 	if c.index == len(c.messages) {
 		return nil, errors.New("could not receive more messages")
 	}
@@ -175,22 +505,72 @@ func (c *mockSQSClient) ReceiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMe
 	}, nil
 }
 
-func (c *mockSQSClient) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
-	var msg *sqs.Message
-	for _, m := range c.messages {
-		if *m.ReceiptHandle == *input.ReceiptHandle {
-			msg = m
-			break
+func (c *mockSQSClient) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.batches = append(c.batches, len(input.Entries))
+	if c.batchErr != nil {
+		return nil, c.batchErr
+	}
+
+	output := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range input.Entries {
+		if senderFault, ok := c.failures[*entry.ReceiptHandle]; ok {
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String("Failure"),
+				Message:     aws.String("could not delete message"),
+				SenderFault: aws.Bool(senderFault),
+			})
+			continue
+		}
+
+		var msg *sqs.Message
+		for _, m := range c.messages {
+			if *m.ReceiptHandle == *entry.ReceiptHandle {
+				msg = m
+				break
+			}
 		}
+		if msg == nil {
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String("ReceiptHandleIsInvalid"),
+				Message:     aws.String(fmt.Sprintf("message not found: %s", *entry.ReceiptHandle)),
+				SenderFault: aws.Bool(true),
+			})
+			continue
+		}
+
+		c.deletedMessages = append(c.deletedMessages, msg)
+		output.Successful = append(output.Successful, &sqs.DeleteMessageBatchResultEntry{Id: entry.Id})
 	}
 
-	if msg == nil {
-		return nil, fmt.Errorf("message not found: %s", *input.ReceiptHandle)
+	return output, nil
+}
+
+func (c *mockSQSClient) deleted() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var handles []string
+	for _, m := range c.deletedMessages {
+		handles = append(handles, *m.ReceiptHandle)
 	}
+	return handles
+}
 
+func (c *mockSQSClient) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
 	c.mutex.Lock()
-	c.deletedMessages = append(c.deletedMessages, msg)
+	c.visibilities = append(c.visibilities, fmt.Sprintf("%s:%d", *input.ReceiptHandle, *input.VisibilityTimeout))
 	c.mutex.Unlock()
 
-	return &sqs.DeleteMessageOutput{}, nil
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (c *mockSQSClient) changedVisibilities() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.visibilities...)
 }
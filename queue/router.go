@@ -0,0 +1,183 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	QueueRouted    = "queue.routed"
+	QueueRouteTime = "queue.route.time"
+)
+
+// route tags of the messages not handled by a route handler
+const (
+	// FallbackRoute tags the messages handled by the fallback handler
+	FallbackRoute = "fallback"
+	// Unrouted tags the messages rejected because they match no route and there is no fallback handler
+	Unrouted = "unrouted"
+)
+
+// ErrNoRoute is returned when a message matches no route and the Router has no fallback handler
+var ErrNoRoute = errors.New("no route for message")
+
+// RouteKey returns the route of a message
+type RouteKey func(m *Message) (string, error)
+
+// ByAttribute routes messages by the value of a message attribute
+func ByAttribute(name string) RouteKey {
+	return func(m *Message) (string, error) {
+		attribute, ok := m.Attributes[name]
+		if !ok || attribute.IsBinary() {
+			return "", fmt.Errorf("missing %s attribute", name)
+		}
+		return attribute.StringValue, nil
+	}
+}
+
+// ByJSONField routes messages by the value of a top-level field of their JSON body
+// The field must be a string or a number
+func ByJSONField(field string) RouteKey {
+	return func(m *Message) (string, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(m.Body), &fields); err != nil {
+			return "", err
+		}
+
+		raw, ok := fields[field]
+		if !ok {
+			return "", fmt.Errorf("missing %s field", field)
+		}
+
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return s, nil
+		}
+		var n float64
+		if err := json.Unmarshal(raw, &n); err == nil {
+			return strconv.FormatFloat(n, 'f', -1, 64), nil
+		}
+		return "", fmt.Errorf("%s field is neither a string nor a number", field)
+	}
+}
+
+// Router is a Handler dispatching messages to other handlers according to their route
+//
+//	router := queue.NewRouter(queue.ByAttribute("type"), metrics.Default)
+//	router.Route("order_created", orderCreatedHandler)
+//	router.Route("order_cancelled", orderCancelledHandler)
+//
+// Routing metrics are tagged with the route, or with FallbackRoute and Unrouted for the messages matching no route
+type Router struct {
+	route   RouteKey
+	metrics metrics.Client
+	clock   clock.Clock
+
+	mutex    sync.RWMutex
+	routes   map[string]Handler
+	fallback Handler
+}
+
+// RouterOption customizes a Router
+type RouterOption interface {
+	applyRouter(r *Router)
+}
+
+// NewRouter creates a Router
+func NewRouter(route RouteKey, metrics metrics.Client, opts ...RouterOption) *Router {
+	r := &Router{
+		route:   route,
+		metrics: metrics,
+		clock:   clock.New(),
+		routes:  map[string]Handler{},
+	}
+
+	for _, opt := range opts {
+		opt.applyRouter(r)
+	}
+
+	return r
+}
+
+// Route registers the handler for the given route
+// It panics if a handler already exists for the route
+func (r *Router) Route(route string, handler Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if handler == nil {
+		panic("queue: nil handler")
+	}
+	if _, exists := r.routes[route]; exists {
+		panic("queue: multiple registrations for route " + route)
+	}
+	r.routes[route] = handler
+}
+
+// RouteFunc registers the handler function for the given route
+func (r *Router) RouteFunc(route string, handler func(ctx context.Context, m *Message) error) {
+	r.Route(route, HandlerFunc(handler))
+}
+
+// Fallback registers the handler of the messages matching no route, including those whose route cannot be found
+// Without fallback, these messages fail with ErrNoRoute
+func (r *Router) Fallback(handler Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.fallback = handler
+}
+
+// Handle implements Handler
+func (r *Router) Handle(ctx context.Context, m *Message) error {
+	start := r.clock.Now()
+
+	tag, handler, err := r.handler(m)
+	if err != nil {
+		r.metrics.WithTags([]string{"route:" + Unrouted, "outcome:error"}).Incr(QueueRouted)
+		return err
+	}
+
+	err = handler.Handle(ctx, m)
+
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	client := r.metrics.WithTags([]string{"route:" + tag, "outcome:" + outcome})
+	client.Incr(QueueRouted)
+	client.Timing(QueueRouteTime, start)
+
+	return err
+}
+
+// handler returns the handler of m and its route tag
+func (r *Router) handler(m *Message) (string, Handler, error) {
+	route, routeErr := r.route(m)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if routeErr == nil {
+		if handler, ok := r.routes[route]; ok {
+			return route, handler, nil
+		}
+	}
+
+	if r.fallback != nil {
+		return FallbackRoute, r.fallback, nil
+	}
+
+	if routeErr != nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrNoRoute, routeErr)
+	}
+	return "", nil, fmt.Errorf("%w: %s", ErrNoRoute, route)
+}
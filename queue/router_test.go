@@ -0,0 +1,130 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterDispatchesByAttribute(t *testing.T) {
+	assert := assert.New(t)
+
+	var handled []string
+	recorder := metrics.NewRecorder(clock.New())
+	router := NewRouter(ByAttribute("type"), recorder)
+	router.RouteFunc("created", func(ctx context.Context, m *Message) error {
+		handled = append(handled, "created:"+m.MessageID)
+		return nil
+	})
+	router.RouteFunc("cancelled", func(ctx context.Context, m *Message) error {
+		handled = append(handled, "cancelled:"+m.MessageID)
+		return errors.New("failed")
+	})
+
+	assert.Nil(router.Handle(context.Background(), &Message{
+		MessageID:  "1",
+		Attributes: map[string]MessageAttribute{"type": StringAttribute("created")},
+	}))
+	assert.Equal("failed", router.Handle(context.Background(), &Message{
+		MessageID:  "2",
+		Attributes: map[string]MessageAttribute{"type": StringAttribute("cancelled")},
+	}).Error())
+
+	assert.Equal([]string{"created:1", "cancelled:2"}, handled)
+	assert.Equal([]string{
+		"queue.routed [route:created outcome:success]",
+		"queue.route.time [route:created outcome:success]",
+		"queue.routed [route:cancelled outcome:error]",
+		"queue.route.time [route:cancelled outcome:error]",
+	}, recorder.Calls())
+}
+
+func TestRouterDispatchesByJSONField(t *testing.T) {
+	assert := assert.New(t)
+
+	var handled []string
+	router := NewRouter(ByJSONField("type"), metrics.Default)
+	router.RouteFunc("created", func(ctx context.Context, m *Message) error {
+		handled = append(handled, "created")
+		return nil
+	})
+	router.RouteFunc("2", func(ctx context.Context, m *Message) error {
+		handled = append(handled, "version 2")
+		return nil
+	})
+
+	assert.Nil(router.Handle(context.Background(), &Message{Body: `{"type": "created", "id": 42}`}))
+	assert.Nil(router.Handle(context.Background(), &Message{Body: `{"type": 2}`}))
+	assert.Equal([]string{"created", "version 2"}, handled)
+}
+
+func TestRouterUsesTheFallbackHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	var handled []string
+	recorder := metrics.NewRecorder(clock.New())
+	router := NewRouter(ByJSONField("type"), recorder)
+	router.RouteFunc("created", func(ctx context.Context, m *Message) error {
+		return nil
+	})
+
+	// no fallback
+	err := router.Handle(context.Background(), &Message{Body: `{"type": "deleted"}`})
+	assert.True(errors.Is(err, ErrNoRoute))
+	assert.Equal("no route for message: deleted", err.Error())
+
+	router.Fallback(HandlerFunc(func(ctx context.Context, m *Message) error {
+		handled = append(handled, m.Body)
+		return nil
+	}))
+
+	// unknown route
+	assert.Nil(router.Handle(context.Background(), &Message{Body: `{"type": "deleted"}`}))
+	// the route cannot be found
+	assert.Nil(router.Handle(context.Background(), &Message{Body: `not json`}))
+
+	assert.Equal([]string{`{"type": "deleted"}`, `not json`}, handled)
+	assert.Equal([]string{
+		"queue.routed [route:unrouted outcome:error]",
+		"queue.routed [route:fallback outcome:success]",
+		"queue.route.time [route:fallback outcome:success]",
+		"queue.routed [route:fallback outcome:success]",
+		"queue.route.time [route:fallback outcome:success]",
+	}, recorder.Calls())
+}
+
+func TestRouterRejectsDuplicateRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	router := NewRouter(ByAttribute("type"), metrics.Default)
+	router.Route("created", HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	}))
+
+	assert.Panics(func() {
+		router.Route("created", HandlerFunc(func(ctx context.Context, m *Message) error {
+			return nil
+		}))
+	})
+}
+
+func TestRouterTimesMessagesWithItsClock(t *testing.T) {
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	recorder := metrics.NewRecorder(c)
+
+	router := NewRouter(ByAttribute("type"), recorder, WithClock(c))
+	router.RouteFunc("created", func(ctx context.Context, m *Message) error {
+		c.Advance(time.Minute)
+		return nil
+	})
+
+	router.Handle(context.Background(), &Message{
+		Attributes: map[string]MessageAttribute{"type": StringAttribute("created")},
+	})
+	assert.Equal(t, []float64{60000}, recorder.Values(QueueRouteTime))
+}
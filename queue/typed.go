@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fchoquet/golibs/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	QueuePoison = "queue.poison"
+)
+
+// Validator is implemented by payloads able to validate themselves
+type Validator interface {
+	Validate() error
+}
+
+// DecodeError reports a malformed payload: invalid JSON or failed validation
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("malformed payload: %s", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// PoisonFunc handles malformed messages
+// The message is acknowledged if it returns nil
+type PoisonFunc func(ctx context.Context, m *Message, err *DecodeError) error
+
+// QuarantinePoison sends malformed messages to a dead-letter queue, with the reason of their failure
+func QuarantinePoison(p Publisher) PoisonFunc {
+	return func(ctx context.Context, m *Message, err *DecodeError) error {
+		_, sendErr := p.Send(ctx, deadLetterMessage(m, err))
+		return sendErr
+	}
+}
+
+// TypedHandler is a Handler decoding JSON message bodies into T before processing them
+//
+//	worker := queue.NewWorker(listener, &queue.TypedHandler[Order]{
+//		Handler: func(ctx context.Context, order Order, m *queue.Message) error {
+//			...
+//		},
+//	}, 10, logger, metrics.Default)
+//
+// Payloads implementing Validator are validated after decoding
+type TypedHandler[T any] struct {
+	// Handler processes the decoded payload. Required
+	Handler func(ctx context.Context, payload T, m *Message) error
+	// Poison handles malformed payloads. If nil, the DecodeError is returned: the message is received again
+	// and can be quarantined with the DeadLetter worker option
+	Poison PoisonFunc
+	// SNS unwraps the messages published by SNS topics without raw message delivery
+	// Messages that are not SNS notifications are decoded as is
+	SNS bool
+	// Logger logs malformed payloads. logrus.StandardLogger() is used if nil
+	Logger log.FieldLogger
+	// Metrics counts malformed payloads. metrics.Default is used if nil
+	Metrics metrics.Client
+}
+
+// Handle implements Handler
+func (h *TypedHandler[T]) Handle(ctx context.Context, m *Message) error {
+	payload, err := h.decode(m)
+	if err != nil {
+		return h.poison(ctx, m, err)
+	}
+
+	return h.Handler(ctx, payload, m)
+}
+
+func (h *TypedHandler[T]) decode(m *Message) (T, *DecodeError) {
+	var payload T
+
+	body := m.Body
+	if h.SNS {
+		body = unwrapSNS(body)
+	}
+
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return payload, &DecodeError{Err: err}
+	}
+
+	// Validate may be defined on T or *T
+	var v interface{} = &payload
+	if _, ok := v.(Validator); !ok {
+		v = payload
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return payload, &DecodeError{Err: err}
+		}
+	}
+
+	return payload, nil
+}
+
+func (h *TypedHandler[T]) poison(ctx context.Context, m *Message, err *DecodeError) error {
+	logger := h.Logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	client := h.Metrics
+	if client == nil {
+		client = metrics.Default
+	}
+
+	logger.WithField("message_id", m.MessageID).WithError(err).Error("Malformed message")
+	client.Incr(QueuePoison)
+
+	if h.Poison == nil {
+		return err
+	}
+	return h.Poison(ctx, m, err)
+}
+
+// snsEnvelope is the JSON document wrapping messages sent by SNS
+type snsEnvelope struct {
+	Type     string `json:"Type"`
+	TopicArn string `json:"TopicArn"`
+	Message  string `json:"Message"`
+}
+
+// unwrapSNS returns the message of an SNS notification, or body itself if it is not a notification
+func unwrapSNS(body string) string {
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+		return body
+	}
+	if envelope.Type != "Notification" || envelope.TopicArn == "" {
+		return body
+	}
+	return envelope.Message
+}
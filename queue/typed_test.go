@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type testOrder struct {
+	ID    string `json:"id"`
+	Total int    `json:"total"`
+}
+
+func (o *testOrder) Validate() error {
+	if o.ID == "" {
+		return errors.New("missing id")
+	}
+	return nil
+}
+
+func TestTypedHandlerDecodesPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	var received testOrder
+	h := &TypedHandler[testOrder]{
+		Handler: func(ctx context.Context, order testOrder, m *Message) error {
+			received = order
+			return nil
+		},
+	}
+
+	err := h.Handle(context.Background(), &Message{Body: `{"id": "42", "total": 100}`})
+	assert.Nil(err)
+	assert.Equal(testOrder{ID: "42", Total: 100}, received)
+}
+
+func TestTypedHandlerRejectsMalformedPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := metrics.NewRecorder(clock.New())
+	h := &TypedHandler[testOrder]{
+		Handler: func(ctx context.Context, order testOrder, m *Message) error {
+			assert.Fail("malformed payloads must not be handled")
+			return nil
+		},
+		Metrics: recorder,
+	}
+
+	// invalid JSON
+	err := h.Handle(context.Background(), &Message{Body: `{"id": `})
+	var decodeErr *DecodeError
+	assert.True(errors.As(err, &decodeErr))
+
+	// failed validation
+	err = h.Handle(context.Background(), &Message{Body: `{"total": 100}`})
+	assert.Equal("malformed payload: missing id", err.Error())
+
+	assert.Equal([]string{"queue.poison []", "queue.poison []"}, recorder.Calls())
+}
+
+func TestTypedHandlerSendsMalformedPayloadsToThePoisonPath(t *testing.T) {
+	assert := assert.New(t)
+
+	dlq := NewMemoryPublisher()
+	h := &TypedHandler[testOrder]{
+		Handler: func(ctx context.Context, order testOrder, m *Message) error {
+			return nil
+		},
+		Poison: QuarantinePoison(dlq),
+	}
+
+	err := h.Handle(context.Background(), &Message{Body: `{"total": 100}`})
+	assert.Nil(err)
+
+	assert.Len(dlq.Messages(), 1)
+	assert.Equal(`{"total": 100}`, dlq.Messages()[0].Body)
+	assert.Equal("malformed payload: missing id", dlq.Messages()[0].Attributes[FailureReasonAttribute].StringValue)
+}
+
+func TestTypedHandlerUnwrapsSNSNotifications(t *testing.T) {
+	assert := assert.New(t)
+
+	var received []testOrder
+	h := &TypedHandler[testOrder]{
+		Handler: func(ctx context.Context, order testOrder, m *Message) error {
+			received = append(received, order)
+			return nil
+		},
+		SNS: true,
+	}
+
+	notification := `{
+		"Type": "Notification",
+		"MessageId": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		"TopicArn": "arn:aws:sns:us-west-2:123456789012:orders",
+		"Message": "{\"id\": \"42\", \"total\": 100}"
+	}`
+	assert.Nil(h.Handle(context.Background(), &Message{Body: notification}))
+
+	// raw messages are still accepted
+	assert.Nil(h.Handle(context.Background(), &Message{Body: `{"id": "43"}`}))
+
+	assert.Equal([]testOrder{{ID: "42", Total: 100}, {ID: "43"}}, received)
+}
@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/fchoquet/golibs/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	QueueHandled      = "queue.handled"
+	QueueHandlingTime = "queue.handling.time"
+	QueueMessageAge   = "queue.message.age"
+)
+
+// Handler processes a message
+// The message is acknowledged when nil is returned. Otherwise it is received again once its visibility timeout expires,
+// or after the RetryBackoff delay. Handlers may also settle the message themselves, with Nack or RequeueAfter for instance
+type Handler interface {
+	Handle(ctx context.Context, m *Message) error
+}
+
+// HandlerFunc is an adapter to use ordinary functions as Handlers
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+// Handle calls f(ctx, m)
+func (f HandlerFunc) Handle(ctx context.Context, m *Message) error {
+	return f(ctx, m)
+}
+
+// Worker processes the messages of a Listener with a pool of goroutines
+type Worker interface {
+	// Run processes messages until ctx is done or the listener closes its channel.
+	// The listener is then stopped and Run waits for the messages in flight to be processed.
+	// The context passed to the handlers is cancelled if they are still running after the shutdown timeout
+	Run(ctx context.Context) error
+}
+
+// WorkerOption customizes a Worker
+type WorkerOption interface {
+	applyWorker(o *workerOptions)
+}
+
+type workerOption func(o *workerOptions)
+
+func (f workerOption) applyWorker(o *workerOptions) {
+	f(o)
+}
+
+type workerOptions struct {
+	clock           clock.Clock
+	shutdownTimeout time.Duration
+	// retryBackoff is nil when failed messages are simply released
+	retryBackoff retry.BackOffFunc
+	// deadLetter is nil when failed messages are never quarantined
+	deadLetter  Publisher
+	maxReceives int
+}
+
+func newWorkerOptions(opts []WorkerOption) workerOptions {
+	o := workerOptions{
+		clock:           clock.New(),
+		shutdownTimeout: 30 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt.applyWorker(&o)
+	}
+
+	return o
+}
+
+// ShutdownTimeout sets how long a Worker waits for the messages in flight when it stops. Default is 30 seconds
+func ShutdownTimeout(d time.Duration) WorkerOption {
+	return workerOption(func(o *workerOptions) {
+		o.shutdownTimeout = d
+	})
+}
+
+// RetryBackoff makes a Worker requeue the messages it failed to process after a delay computed by backoff
+// from their receive count. By default failed messages are received again once their visibility timeout expires
+func RetryBackoff(backoff retry.BackOffFunc) WorkerOption {
+	return workerOption(func(o *workerOptions) {
+		o.retryBackoff = backoff
+	})
+}
+
+// DeadLetter makes a Worker move the messages it failed to process maxReceives times to a dead-letter queue
+// The quarantined messages keep their attributes. FailureReasonAttribute and StackTraceAttribute are added to them
+// Since SQS accepts up to MaxAttributes attributes per message, the original attributes that do not fit
+// are merged into OriginalAttributesAttribute
+func DeadLetter(p Publisher, maxReceives int) WorkerOption {
+	return workerOption(func(o *workerOptions) {
+		o.deadLetter = p
+		o.maxReceives = maxReceives
+	})
+}
+
+// NewWorker creates a default Worker implementation
+// concurrency is the number of messages processed at the same time
+func NewWorker(listener Listener, handler Handler, concurrency int, logger log.FieldLogger, metrics metrics.Client, opts ...WorkerOption) Worker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &worker{
+		listener:      listener,
+		handler:       handler,
+		concurrency:   concurrency,
+		logger:        logger,
+		metrics:       metrics,
+		workerOptions: newWorkerOptions(opts),
+	}
+}
+
+type worker struct {
+	listener    Listener
+	handler     Handler
+	concurrency int
+	logger      log.FieldLogger
+	metrics     metrics.Client
+	workerOptions
+}
+
+func (w *worker) Run(ctx context.Context) error {
+	// handlers are not interrupted as soon as ctx is done to let them finish their job
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, e := w.listener.Listen()
+
+	// errors are already logged by the listener, but the channel must be drained
+	go func() {
+		for range e {
+		}
+	}()
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range c {
+				w.handle(handlerCtx, msg)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-done:
+	}
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), w.shutdownTimeout)
+	defer stopCancel()
+
+	err := w.listener.Stop(stopCtx)
+	if err != nil {
+		w.logger.WithError(err).Warn("Worker stopped before all the messages were processed")
+		// let's ask the handlers still running to give up
+		cancel()
+	}
+
+	<-done
+	return err
+}
+
+// handle processes a single message, acknowledging it on success
+func (w *worker) handle(ctx context.Context, msg *Message) {
+	start := w.clock.Now()
+	logger := w.logger.WithField("message_id", msg.MessageID)
+
+	if !msg.SentTimestamp.IsZero() {
+		// time spent in the queue
+		w.metrics.Timing(QueueMessageAge, msg.SentTimestamp)
+	}
+
+	outcome := "success"
+	defer func() {
+		m := w.metrics.WithTag("outcome:" + outcome)
+		m.Incr(QueueHandled)
+		m.Timing(QueueHandlingTime, start)
+	}()
+
+	if err := w.safeHandle(ctx, msg); err != nil {
+		outcome = "error"
+		if _, ok := err.(panicError); ok {
+			outcome = "panic"
+		}
+		logger.WithError(err).Error("Could not handle message")
+		if msg.isSettled.Load() {
+			// the handler already chose what to do with the message
+			return
+		}
+		if w.shouldQuarantine(msg) && w.quarantine(ctx, msg, err) {
+			outcome = "quarantined"
+			msg.Ack()
+			return
+		}
+		if w.retryBackoff != nil {
+			msg.RequeueWithBackoff(w.retryBackoff)
+			return
+		}
+		msg.Release()
+		return
+	}
+
+	msg.Ack()
+}
+
+// safeHandle calls the handler, turning panics into errors
+func (w *worker) safeHandle(ctx context.Context, msg *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			w.logger.WithField("message_id", msg.MessageID).Errorf("[panic recovered] %s: %s", r, stack)
+			err = panicError{value: r, stack: stack}
+		}
+	}()
+
+	return w.handler.Handle(ctx, msg)
+}
+
+// panicError reports a panic recovered while handling a message
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
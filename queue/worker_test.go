@@ -0,0 +1,262 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/fchoquet/golibs/retry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerAcksHandledMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("ok-0", "ok-1", "ok-2")
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	})
+
+	w := NewWorker(l, handler, 2, logrus.StandardLogger(), metrics.Default)
+	assert.Nil(w.Run(context.Background()))
+
+	assert.ElementsMatch([]string{"ok-0", "ok-1", "ok-2"}, l.acked())
+	assert.Empty(l.released())
+	assert.True(l.stopped)
+}
+
+func TestWorkerReleasesFailedMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("ok", "fail", "panic")
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		switch m.MessageID {
+		case "fail":
+			return errors.New("failed")
+		case "panic":
+			panic("oops")
+		}
+		return nil
+	})
+
+	recorder := metrics.NewRecorder(clock.New())
+	w := NewWorker(l, handler, 1, logrus.StandardLogger(), recorder)
+	assert.Nil(w.Run(context.Background()))
+
+	assert.Equal([]string{"ok"}, l.acked())
+	assert.Equal([]string{"fail", "panic"}, l.released())
+	assert.Equal([]string{
+		"queue.handled [outcome:success]",
+		"queue.handling.time [outcome:success]",
+		"queue.handled [outcome:error]",
+		"queue.handling.time [outcome:error]",
+		"queue.handled [outcome:panic]",
+		"queue.handling.time [outcome:panic]",
+	}, recorder.Calls())
+}
+
+func TestWorkerRunsConcurrently(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("0", "1", "2")
+	started := make(chan struct{}, 3)
+	unblock := make(chan struct{})
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		started <- struct{}{}
+		<-unblock
+		return nil
+	})
+
+	w := NewWorker(l, handler, 3, logrus.StandardLogger(), metrics.Default)
+	done := make(chan error)
+	go func() {
+		done <- w.Run(context.Background())
+	}()
+
+	// all the handlers run at the same time
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	close(unblock)
+
+	assert.Nil(<-done)
+	assert.Len(l.acked(), 3)
+}
+
+func TestWorkerStopsWhenTheContextIsDone(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener()
+	l.keepOpen = true
+	w := NewWorker(l, HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	}), 1, logrus.StandardLogger(), metrics.Default)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	cancel()
+	assert.Nil(<-done)
+	assert.True(l.stopped)
+}
+
+func TestWorkerCancelsHandlersAfterTheShutdownTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("slow")
+	l.keepOpen = true
+	started := make(chan struct{})
+	w := NewWorker(l, HandlerFunc(func(ctx context.Context, m *Message) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}), 1, logrus.StandardLogger(), metrics.Default, ShutdownTimeout(10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	<-started
+	cancel()
+	assert.Equal(context.DeadlineExceeded, <-done)
+	assert.Equal([]string{"slow"}, l.released())
+}
+
+func TestWorkerRequeuesFailedMessagesWithBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("fail")
+	l.messages[0].ReceiveCount = 2
+	handler := HandlerFunc(func(ctx context.Context, m *Message) error {
+		return errors.New("failed")
+	})
+
+	w := NewWorker(l, handler, 1, logrus.StandardLogger(), metrics.Default, RetryBackoff(retry.Linear(time.Minute, time.Hour)))
+	assert.Nil(w.Run(context.Background()))
+
+	assert.Equal([]string{"fail:2m0s"}, l.visibilities)
+	assert.Equal([]string{"fail"}, l.released())
+}
+
+func TestWorkerMeasuresMessageAge(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newTestListener("old")
+	l.messages[0].SentTimestamp = time.Now().Add(-time.Minute)
+
+	recorder := metrics.NewRecorder(clock.New())
+	w := NewWorker(l, HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	}), 1, logrus.StandardLogger(), recorder)
+	assert.Nil(w.Run(context.Background()))
+
+	assert.Contains(recorder.Calls(), "queue.message.age []")
+}
+
+// testListener is an in-memory Listener recording acks and releases
+type testListener struct {
+	messages []*Message
+	// keepOpen keeps the channel open until Stop is called
+	keepOpen bool
+	stopped  bool
+
+	c            chan *Message
+	stop         chan struct{}
+	pending      sync.WaitGroup
+	mutex        sync.Mutex
+	acks         []string
+	releases     []string
+	visibilities []string
+}
+
+func newTestListener(ids ...string) *testListener {
+	l := &testListener{}
+	for _, id := range ids {
+		l.messages = append(l.messages, &Message{MessageID: id, acker: l})
+	}
+	return l
+}
+
+func (l *testListener) Listen() (<-chan *Message, <-chan error) {
+	l.c = make(chan *Message)
+	l.stop = make(chan struct{})
+
+	go func() {
+		defer close(l.c)
+		for _, m := range l.messages {
+			l.pending.Add(1)
+			l.c <- m
+		}
+		if l.keepOpen {
+			<-l.stop
+		}
+	}()
+
+	return l.c, make(chan error)
+}
+
+func (l *testListener) LastRequest() *time.Duration {
+	return nil
+}
+
+func (l *testListener) Stop(ctx context.Context) error {
+	l.stopped = true
+	close(l.stop)
+
+	drained := make(chan struct{})
+	go func() {
+		l.pending.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *testListener) ack(m *Message) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.acks = append(l.acks, m.MessageID)
+	l.pending.Done()
+}
+
+func (l *testListener) release(m *Message) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.releases = append(l.releases, m.MessageID)
+	l.pending.Done()
+}
+
+func (l *testListener) changeVisibility(m *Message, d time.Duration) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.visibilities = append(l.visibilities, fmt.Sprintf("%s:%s", m.MessageID, d))
+	return nil
+}
+
+func (l *testListener) acked() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.acks
+}
+
+func (l *testListener) released() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.releases
+}
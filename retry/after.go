@@ -0,0 +1,85 @@
+package retry
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultMaxRetryAfter is the default maximum delay a Retrier accepts to wait when an error requests a delay
+// Feel free to override in your project, or use the MaxRetryAfter option
+var DefaultMaxRetryAfter = 1 * time.Minute
+
+// MaxRetryAfter sets the maximum delay the Retrier accepts to wait when an error requests a delay
+// Longer delays are shortened to this value
+func MaxRetryAfter(d time.Duration) Option {
+	return func(r *retrier) {
+		r.maxRetryAfter = d
+	}
+}
+
+// After wraps err to request a specific delay before the next attempt
+// The default Retrier uses it instead of its back off strategy
+func After(err error, d time.Duration) error {
+	return &retryAfterError{
+		err:   err,
+		delay: d,
+	}
+}
+
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// retryAfterDelay returns the delay requested by err, if any
+func retryAfterDelay(err error) (time.Duration, bool) {
+	var retryAfterErr *retryAfterError
+	if !errors.As(err, &retryAfterErr) {
+		return 0, false
+	}
+	return retryAfterErr.delay, true
+}
+
+// retryAfterHeader extracts the delay requested by a server from the response headers
+// Retry-After can be either a number of seconds or an http date
+// X-RateLimit-Reset can be either a number of seconds or a unix timestamp
+// Dates and timestamps are set by the server's wall clock so now must be the wall time, not the retrier's clock
+func retryAfterHeader(h http.Header, now time.Time) (time.Duration, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return positive(time.Duration(seconds) * time.Second), true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return positive(t.Sub(now)), true
+		}
+	}
+
+	if v := h.Get("X-RateLimit-Reset"); v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			// no sane delay is expressed as a number of seconds greater than a recent timestamp
+			if seconds > 1000000000 {
+				return positive(time.Unix(seconds, 0).Sub(now)), true
+			}
+			return positive(time.Duration(seconds) * time.Second), true
+		}
+	}
+
+	return 0, false
+}
+
+func positive(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
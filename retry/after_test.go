@@ -0,0 +1,106 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRetryAfterOverridesBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	var waits []time.Duration
+	r := New(4, TestBackoff,
+		MaxRetryAfter(10*time.Millisecond),
+		OnRetry(func(ctx context.Context, attempt Attempt, wait time.Duration) {
+			waits = append(waits, wait)
+		}),
+	)
+
+	attemptErr := errors.New("rate limited")
+	err := r.Retry(func(attempt int) (error, bool) {
+		switch attempt {
+		case 1:
+			return After(attemptErr, 2*time.Millisecond), true
+		case 2:
+			// longer than the ceiling
+			return After(attemptErr, time.Hour), true
+		default:
+			return attemptErr, true
+		}
+	})
+
+	assert.True(errors.Is(err, attemptErr))
+	assert.Equal([]time.Duration{2 * time.Millisecond, 10 * time.Millisecond, time.Microsecond}, waits)
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	fixtures := []struct {
+		header   string
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"Retry-After", "120", 2 * time.Minute, true},
+		{"Retry-After", "Tue, 01 May 2018 12:00:30 GMT", 30 * time.Second, true},
+		{"Retry-After", "Tue, 01 May 2018 11:00:00 GMT", 0, true},
+		{"Retry-After", "soon", 0, false},
+		{"X-RateLimit-Reset", "15", 15 * time.Second, true},
+		{"X-RateLimit-Reset", "1525176060", time.Minute, true},
+		{"X-Whatever", "15", 0, false},
+	}
+
+	for _, fixture := range fixtures {
+		h := http.Header{}
+		h.Set(fixture.header, fixture.value)
+
+		d, ok := retryAfterHeader(h, now)
+		assert.Equal(fixture.ok, ok, "%s: %s", fixture.header, fixture.value)
+		assert.Equal(fixture.expected, d, "%s: %s", fixture.header, fixture.value)
+	}
+}
+
+func TestSendHTTPRequestRetriesTooManyRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	var waits []time.Duration
+	r := New(3, TestBackoff, OnRetry(func(ctx context.Context, attempt Attempt, wait time.Duration) {
+		waits = append(waits, wait)
+	}))
+
+	header := http.Header{}
+	header.Set("Retry-After", "0")
+
+	httpClient := &mockHTTPDoer{}
+	httpClient.On("Do", mock.Anything).Return(&http.Response{
+		StatusCode: 429,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader("slow down")),
+	}, nil).Once()
+	httpClient.On("Do", mock.Anything).Return(&http.Response{
+		StatusCode: 503,
+		Body:       ioutil.NopCloser(strings.NewReader("unavailable")),
+	}, nil).Once()
+	httpClient.On("Do", mock.Anything).Return(&http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(strings.NewReader("ok")),
+	}, nil).Once()
+
+	res, err := SendHTTPRequest(r, httpClient, &http.Request{})
+
+	assert.Nil(err)
+	assert.Equal(200, res.StatusCode)
+	// Retry-After was used first, then the back off strategy
+	assert.Equal([]time.Duration{0, time.Microsecond}, waits)
+}
@@ -2,6 +2,8 @@ package retry
 
 import (
 	"math"
+	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -14,3 +16,119 @@ var PowBackoff BackOffFunc = func(i int) time.Duration {
 var TestBackoff BackOffFunc = func(i int) time.Duration {
 	return 1 * time.Microsecond
 }
+
+// Constant always waits for the same duration
+func Constant(d time.Duration) BackOffFunc {
+	return func(i int) time.Duration {
+		return d
+	}
+}
+
+// Linear waits step, 2*step, 3*step, ...
+// Waits are capped to max. A zero max means no cap
+func Linear(step, max time.Duration) BackOffFunc {
+	return func(i int) time.Duration {
+		return capped(float64(step)*float64(i), max)
+	}
+}
+
+// Exponential waits base, base*multiplier, base*multiplier^2, ...
+// Waits are capped to max. A zero max means no cap
+func Exponential(base time.Duration, multiplier float64, max time.Duration) BackOffFunc {
+	return func(i int) time.Duration {
+		return capped(float64(base)*math.Pow(multiplier, float64(i-1)), max)
+	}
+}
+
+// FullJitter waits a random duration between 0 and the capped exponential backoff (base*2^(i-1))
+// It spreads the retries of concurrent clients as much as possible
+// src is used to generate random numbers. Pass a seeded source (rand.NewSource) to get reproducible results,
+// or nil to use a source seeded with the current time
+func FullJitter(base, max time.Duration, src rand.Source) BackOffFunc {
+	rnd := newLockedRand(src)
+	exp := Exponential(base, 2, max)
+
+	return func(i int) time.Duration {
+		return rnd.between(0, exp(i))
+	}
+}
+
+// EqualJitter waits half of the capped exponential backoff (base*2^(i-1)) plus a random duration
+// between 0 and the other half. It guarantees a minimal wait while still spreading retries
+// See FullJitter for the meaning of src
+func EqualJitter(base, max time.Duration, src rand.Source) BackOffFunc {
+	rnd := newLockedRand(src)
+	exp := Exponential(base, 2, max)
+
+	return func(i int) time.Duration {
+		half := exp(i) / 2
+		return half + rnd.between(0, half)
+	}
+}
+
+// DecorrelatedJitter waits a random duration between base and 3 times the previous wait, capped to max
+// The previous wait is reset when the func is called for a new retry sequence (i = 1) so the returned
+// BackOffFunc should not be shared by concurrent retry sequences if accurate results are expected
+// See FullJitter for the meaning of src
+func DecorrelatedJitter(base, max time.Duration, src rand.Source) BackOffFunc {
+	rnd := newLockedRand(src)
+
+	var mutex sync.Mutex
+	previous := base
+
+	return func(i int) time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if i <= 1 {
+			previous = base
+		}
+
+		previous = capped(float64(rnd.between(base, 3*previous)), max)
+		return previous
+	}
+}
+
+// capped converts d to a duration no greater than max and protects against overflows
+func capped(d float64, max time.Duration) time.Duration {
+	if max > 0 && d > float64(max) {
+		return max
+	}
+	if d >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// lockedRand is a goroutine-safe random generator
+// BackOffFuncs can be shared by several retriers so they must be safe for concurrent use
+type lockedRand struct {
+	mutex sync.Mutex
+	rnd   *rand.Rand
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	return &lockedRand{
+		rnd: rand.New(src),
+	}
+}
+
+// between returns a random duration in [min, max]
+func (r *lockedRand) between(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// max - min + 1 can overflow when max is the biggest duration
+	n := int64(max - min)
+	if n < math.MaxInt64 {
+		n++
+	}
+	return min + time.Duration(r.rnd.Int63n(n))
+}
@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"math/rand"
 	"testing"
 	"time"
 
@@ -25,3 +26,87 @@ func TestPowBackoff(t *testing.T) {
 		assert.Equal(time.Duration(fixture.expected)*time.Second, PowBackoff(fixture.attempt))
 	}
 }
+
+func TestConstantBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	b := Constant(3 * time.Second)
+	for i := 1; i < 5; i++ {
+		assert.Equal(3*time.Second, b(i))
+	}
+}
+
+func TestLinearBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	b := Linear(2*time.Second, 5*time.Second)
+
+	assert.Equal(2*time.Second, b(1))
+	assert.Equal(4*time.Second, b(2))
+	// capped
+	assert.Equal(5*time.Second, b(3))
+	assert.Equal(5*time.Second, b(100))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	b := Exponential(100*time.Millisecond, 3, 2*time.Second)
+
+	assert.Equal(100*time.Millisecond, b(1))
+	assert.Equal(300*time.Millisecond, b(2))
+	assert.Equal(900*time.Millisecond, b(3))
+	// capped
+	assert.Equal(2*time.Second, b(4))
+	assert.Equal(2*time.Second, b(1000))
+
+	// no cap but no overflow either
+	assert.True(Exponential(time.Second, 2, 0)(1000) > 0)
+}
+
+func TestJitterBackoffs(t *testing.T) {
+	assert := assert.New(t)
+
+	base := 100 * time.Millisecond
+	max := 10 * time.Second
+
+	fixtures := []struct {
+		name    string
+		backoff func(src rand.Source) BackOffFunc
+		min     func(i int) time.Duration
+		max     func(i int) time.Duration
+	}{
+		{
+			name:    "full jitter",
+			backoff: func(src rand.Source) BackOffFunc { return FullJitter(base, max, src) },
+			min:     func(i int) time.Duration { return 0 },
+			max:     Exponential(base, 2, max),
+		},
+		{
+			name:    "equal jitter",
+			backoff: func(src rand.Source) BackOffFunc { return EqualJitter(base, max, src) },
+			min:     func(i int) time.Duration { return Exponential(base, 2, max)(i) / 2 },
+			max:     Exponential(base, 2, max),
+		},
+		{
+			name:    "decorrelated jitter",
+			backoff: func(src rand.Source) BackOffFunc { return DecorrelatedJitter(base, max, src) },
+			min:     func(i int) time.Duration { return base },
+			max:     func(i int) time.Duration { return max },
+		},
+	}
+
+	for _, fixture := range fixtures {
+		b1 := fixture.backoff(rand.NewSource(42))
+		b2 := fixture.backoff(rand.NewSource(42))
+
+		for i := 1; i <= 20; i++ {
+			d := b1(i)
+			assert.True(d >= fixture.min(i), "%s: %s is too short for attempt %d", fixture.name, d, i)
+			assert.True(d <= fixture.max(i), "%s: %s is too long for attempt %d", fixture.name, d, i)
+
+			// same seed, same results
+			assert.Equal(d, b2(i), fixture.name)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package retry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+)
+
+// Budget limits the number of retries made by all the retriers sharing it
+// It prevents retries from multiplying the load on a failing dependency
+type Budget interface {
+	// Deposit is called at the beginning of every retry sequence
+	Deposit()
+	// Withdraw is called before every retry. It returns false if the budget is exhausted
+	Withdraw() bool
+}
+
+// WithBudget attaches a budget to the Retrier
+// When the budget is exhausted, the Retrier gives up immediately with the BudgetExhausted outcome
+func WithBudget(b Budget) Option {
+	return func(r *retrier) {
+		r.budget = b
+	}
+}
+
+// BudgetOption customizes the Budget returned by NewBudget
+type BudgetOption func(b *tokenBucket)
+
+// BudgetClock sets the clock used to earn tokens over time. Use a fake clock in tests
+func BudgetClock(c clock.Clock) BudgetOption {
+	return func(b *tokenBucket) {
+		b.clock = c
+	}
+}
+
+// NewBudget creates a token bucket Budget
+// Every retry sequence deposits ratio tokens and every retry withdraws one: 0.1 allows retries for 10% of the requests
+// minPerSecond tokens are added every second so that services with a low traffic can still retry
+// The bucket holds at most max tokens so that a long period without retries does not allow a retry storm.
+// It starts full
+func NewBudget(ratio, minPerSecond, max float64, options ...BudgetOption) Budget {
+	b := &tokenBucket{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		max:          max,
+		balance:      max,
+		clock:        clock.New(),
+	}
+
+	for _, option := range options {
+		option(b)
+	}
+
+	return b
+}
+
+type tokenBucket struct {
+	ratio        float64
+	minPerSecond float64
+	max          float64
+	clock        clock.Clock
+
+	mutex   sync.Mutex
+	balance float64
+	last    time.Time
+}
+
+func (b *tokenBucket) Deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.add(b.ratio)
+}
+
+func (b *tokenBucket) Withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.add(0)
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// add adds tokens, including the ones earned over time. Must be called with the mutex locked
+func (b *tokenBucket) add(tokens float64) {
+	now := b.clock.Now()
+	if !b.last.IsZero() {
+		tokens += now.Sub(b.last).Seconds() * b.minPerSecond
+	}
+	b.last = now
+
+	b.balance += tokens
+	if b.balance > b.max {
+		b.balance = b.max
+	}
+}
@@ -0,0 +1,68 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	b := NewBudget(0.5, 1, 2, BudgetClock(c))
+
+	// starts full
+	assert.True(b.Withdraw())
+	assert.True(b.Withdraw())
+	assert.False(b.Withdraw())
+
+	// 2 requests allow 1 retry
+	b.Deposit()
+	assert.False(b.Withdraw())
+	b.Deposit()
+	assert.True(b.Withdraw())
+	assert.False(b.Withdraw())
+
+	// 1 token per second
+	c.Advance(time.Second)
+	assert.True(b.Withdraw())
+	assert.False(b.Withdraw())
+
+	// never more than max
+	c.Advance(time.Hour)
+	assert.True(b.Withdraw())
+	assert.True(b.Withdraw())
+	assert.False(b.Withdraw())
+}
+
+func TestRetrierGivesUpWhenBudgetIsExhausted(t *testing.T) {
+	assert := assert.New(t)
+
+	client := metrics.NewRecorder(clock.New())
+	budget := NewBudget(0, 0, 3)
+	r := New(3, TestBackoff, WithBudget(budget), Metrics(client, "call_api"))
+
+	attemptErr := errors.New("failed")
+	do := func(attempt int) (error, bool) {
+		return attemptErr, true
+	}
+
+	// first sequence uses 2 tokens
+	assert.Equal(attemptErr, r.Retry(do))
+
+	// second one can only retry once
+	calls := 0
+	err := r.Retry(func(attempt int) (error, bool) {
+		calls++
+		return attemptErr, true
+	})
+	assert.Equal(attemptErr, err)
+	assert.Equal(2, calls)
+
+	assert.Contains(client.Calls(), "retry.budget_exhausted [operation:call_api outcome:budget_exhausted]")
+}
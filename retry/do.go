@@ -0,0 +1,93 @@
+package retry
+
+import (
+	"context"
+	"errors"
+)
+
+// Do calls fn with the Retrier until it succeeds and returns its value
+// Errors are retried unless they are wrapped with Permanent. The value returned by the last attempt is always returned,
+// even if it failed. Retriers not implementing ContextRetrier are adapted with WithContext
+func Do[T any](ctx context.Context, r Retrier, fn func(ctx context.Context, attempt int) (T, error)) (T, error) {
+	var value T
+
+	err := WithContext(r).RetryContext(ctx, func(ctx context.Context, attempt int) (error, bool) {
+		var err error
+		value, err = fn(ctx, attempt)
+		if err == nil {
+			return nil, false
+		}
+		// the markers are only meant for the retrier
+		return unmark(err), IsRetryable(err)
+	})
+
+	return value, err
+}
+
+// Permanent wraps err to signal that it must not be retried
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// Retryable wraps err to signal that it can be retried, even if it wraps a permanent error
+func Retryable(err error) error {
+	return &retryableError{err}
+}
+
+// IsRetryable states if err can be retried according to the outermost Permanent or Retryable wrapper
+// Errors without wrapper are retryable
+func IsRetryable(err error) bool {
+	for err != nil {
+		switch err.(type) {
+		case *permanentError:
+			return false
+		case *retryableError:
+			return true
+		}
+		err = errors.Unwrap(err)
+	}
+	return true
+}
+
+// mark wraps err with Permanent if it must not be retried
+func mark(err error, retry bool) error {
+	if retry {
+		return err
+	}
+	return Permanent(err)
+}
+
+// unmark removes the outermost wrapper added by Permanent or Retryable
+func unmark(err error) error {
+	switch e := err.(type) {
+	case *permanentError:
+		return e.err
+	case *retryableError:
+		return e.err
+	}
+	return err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
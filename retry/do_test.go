@@ -0,0 +1,56 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoReturnsTheValue(t *testing.T) {
+	assert := assert.New(t)
+
+	v, err := Do(context.Background(), New(3, TestBackoff), func(ctx context.Context, attempt int) (string, error) {
+		if attempt < 3 {
+			return "", fmt.Errorf("Error on attempt #%d", attempt)
+		}
+		return "success", nil
+	})
+
+	assert.NoError(err)
+	assert.Equal("success", v)
+}
+
+func TestDoDoesNotRetryPermanentErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	attemptErr := errors.New("bad request")
+
+	calls := 0
+	v, err := Do(context.Background(), New(3, TestBackoff), func(ctx context.Context, attempt int) (int, error) {
+		calls++
+		return 42, Permanent(attemptErr)
+	})
+
+	assert.Equal(1, calls)
+	// the last value is returned anyway
+	assert.Equal(42, v)
+	// the marker is removed
+	assert.Equal(attemptErr, err)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert := assert.New(t)
+
+	err := errors.New("failure")
+
+	assert.True(IsRetryable(err))
+	assert.False(IsRetryable(Permanent(err)))
+	assert.True(IsRetryable(Retryable(err)))
+	assert.False(IsRetryable(fmt.Errorf("wrapped: %w", Permanent(err))))
+	// the outermost wrapper wins
+	assert.True(IsRetryable(Retryable(fmt.Errorf("wrapped: %w", Permanent(err)))))
+	assert.True(errors.Is(Permanent(err), err))
+}
@@ -0,0 +1,254 @@
+package retry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	HedgeSent = "hedge.sent"
+	HedgeWon  = "hedge.won"
+)
+
+// HedgeDelay decides how long to wait for a response before sending a hedged request
+type HedgeDelay interface {
+	// Delay returns the time to wait before sending a new request
+	Delay() time.Duration
+	// Observe records the latency of a request that got a response
+	Observe(latency time.Duration)
+}
+
+// FixedHedgeDelay always waits for the same duration
+func FixedHedgeDelay(d time.Duration) HedgeDelay {
+	return fixedHedgeDelay(d)
+}
+
+type fixedHedgeDelay time.Duration
+
+func (d fixedHedgeDelay) Delay() time.Duration {
+	return time.Duration(d)
+}
+
+func (d fixedHedgeDelay) Observe(latency time.Duration) {}
+
+// PercentileHedgeDelay waits for the given percentile (0.95 for instance) of the latencies of the last size requests
+// initial is used until size latencies have been observed
+func PercentileHedgeDelay(percentile float64, size int, initial time.Duration) HedgeDelay {
+	return &percentileHedgeDelay{
+		percentile: percentile,
+		latencies:  make([]time.Duration, 0, size),
+		size:       size,
+		initial:    initial,
+	}
+}
+
+type percentileHedgeDelay struct {
+	percentile float64
+	size       int
+	initial    time.Duration
+
+	mutex     sync.Mutex
+	latencies []time.Duration
+	// next is the index of the next latency to replace once the buffer is full
+	next int
+}
+
+func (d *percentileHedgeDelay) Delay() time.Duration {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.latencies) < d.size || d.size == 0 {
+		return d.initial
+	}
+
+	sorted := append([]time.Duration{}, d.latencies...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	i := int(d.percentile * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func (d *percentileHedgeDelay) Observe(latency time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.size == 0 {
+		return
+	}
+
+	if len(d.latencies) < d.size {
+		d.latencies = append(d.latencies, latency)
+		return
+	}
+	d.latencies[d.next] = latency
+	d.next = (d.next + 1) % d.size
+}
+
+// Hedger sends hedged requests: when a request has not been answered after a delay, the same request is sent again
+// and the first response wins. The other requests are cancelled.
+// Only idempotent requests are hedged, and only if their body can be sent again (see http.Request.GetBody)
+type Hedger struct {
+	// Delay decides when to send hedged requests. Required
+	Delay HedgeDelay
+	// MaxHedges is the maximum number of hedged requests sent for a single request. Default is 1
+	MaxHedges int
+	// MaxOutstanding is the maximum number of hedged requests in flight at the same time
+	// for all the requests sent with this Hedger. Zero means no limit
+	MaxOutstanding int
+	// Metrics counts hedged requests sent and won. metrics.Default is used if nil
+	Metrics metrics.Client
+	// Clock measures latencies and delays. clock.New() is used if nil
+	Clock clock.Clock
+
+	outstanding int64
+}
+
+// SendHedgedRequest sends an http request using the provided Hedger
+// Use a Transport with a Hedger to combine retries and hedging
+func SendHedgedRequest(h *Hedger, client httpDoer, req *http.Request) (*http.Response, error) {
+	return h.send(req, client.Do)
+}
+
+type hedgeResult struct {
+	res     *http.Response
+	err     error
+	index   int
+	latency time.Duration
+	cancel  context.CancelFunc
+}
+
+func (h *Hedger) send(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if !isIdempotent(req) || (hasBody && req.GetBody == nil) {
+		return send(req)
+	}
+
+	maxHedges := h.MaxHedges
+	if maxHedges <= 0 {
+		maxHedges = 1
+	}
+	m := h.Metrics
+	if m == nil {
+		m = metrics.Default
+	}
+	c := h.Clock
+	if c == nil {
+		c = clock.New()
+	}
+
+	results := make(chan hedgeResult, maxHedges+1)
+	var cancels []context.CancelFunc
+	launch := func(index int, body io.ReadCloser) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		hedgeReq := req.Clone(ctx)
+		hedgeReq.Body = body
+
+		go func() {
+			start := c.Now()
+			res, err := send(hedgeReq)
+			if index > 0 {
+				atomic.AddInt64(&h.outstanding, -1)
+			}
+			results <- hedgeResult{res: res, err: err, index: index, latency: c.Since(start), cancel: cancel}
+		}()
+	}
+
+	launch(0, req.Body)
+	launched, pending := 1, 1
+
+	timer := c.NewTimer(h.Delay.Delay())
+	defer timer.Stop()
+
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				h.Delay.Observe(r.latency)
+				if r.index > 0 {
+					m.Incr(HedgeWon)
+				}
+				for i, cancel := range cancels {
+					if i != r.index {
+						cancel()
+					}
+				}
+				go discardHedges(results, pending)
+				r.res.Body = &cancelOnClose{ReadCloser: r.res.Body, cancel: r.cancel}
+				return r.res, nil
+			}
+			r.cancel()
+			last = r
+
+		case <-timer.C():
+			if launched > maxHedges || !h.acquire() {
+				continue
+			}
+
+			body := req.Body
+			if hasBody {
+				var err error
+				if body, err = req.GetBody(); err != nil {
+					atomic.AddInt64(&h.outstanding, -1)
+					continue
+				}
+			}
+
+			launch(launched, body)
+			launched++
+			pending++
+			m.Incr(HedgeSent)
+			timer.Reset(h.Delay.Delay())
+		}
+	}
+
+	// all the requests failed
+	return nil, last.err
+}
+
+// acquire reserves a slot for a hedged request
+func (h *Hedger) acquire() bool {
+	if atomic.AddInt64(&h.outstanding, 1) > int64(h.MaxOutstanding) && h.MaxOutstanding > 0 {
+		atomic.AddInt64(&h.outstanding, -1)
+		return false
+	}
+	return true
+}
+
+// discardHedges closes the responses of the requests that lost the race
+func discardHedges(results <-chan hedgeResult, pending int) {
+	for i := 0; i < pending; i++ {
+		r := <-results
+		if r.res != nil {
+			r.res.Body.Close()
+		}
+	}
+}
+
+// cancelOnClose releases the context of the winning request when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,140 @@
+package retry
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/fchoquet/golibs/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSlowServer returns a server answering slowly to its first request only
+// The slow request blocks until the client gives up
+func newSlowServer() (*httptest.Server, *int32, chan struct{}) {
+	var count int32
+	cancelled := make(chan struct{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&count, 1) == 1 {
+			<-r.Context().Done()
+			cancelled <- struct{}{}
+			return
+		}
+		w.Write([]byte("fast " + string(body)))
+	}))
+
+	return server, &count, cancelled
+}
+
+func TestSendHedgedRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	server, count, cancelled := newSlowServer()
+	defer server.Close()
+
+	client := metrics.NewRecorder(clock.New())
+	h := &Hedger{
+		Delay:   FixedHedgeDelay(10 * time.Millisecond),
+		Metrics: client,
+	}
+
+	req, _ := http.NewRequest("PUT", server.URL, strings.NewReader("hello"))
+	res, err := SendHedgedRequest(h, http.DefaultClient, req)
+	assert.NoError(err)
+
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal("fast hello", string(body))
+	assert.Equal(int32(2), atomic.LoadInt32(count))
+
+	// the slow request was cancelled
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the slow request was not cancelled")
+	}
+
+	assert.Equal([]string{"hedge.sent []", "hedge.won []"}, client.Calls())
+}
+
+func TestSendHedgedRequestDoesNotHedgeNonIdempotentRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	server, count, _ := newSlowServer()
+	defer server.Close()
+
+	h := &Hedger{Delay: FixedHedgeDelay(time.Millisecond)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader("hello"))
+	_, err := SendHedgedRequest(h, http.DefaultClient, req.WithContext(ctx))
+
+	assert.Error(err)
+	assert.Equal(int32(1), atomic.LoadInt32(count))
+}
+
+func TestHedgerRespectsMaxOutstanding(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &Hedger{MaxOutstanding: 1}
+	assert.True(h.acquire())
+	assert.False(h.acquire())
+
+	atomic.AddInt64(&h.outstanding, -1)
+	assert.True(h.acquire())
+}
+
+func TestTransportWithHedger(t *testing.T) {
+	assert := assert.New(t)
+
+	server, count, _ := newSlowServer()
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &Transport{
+			Retrier: New(3, TestBackoff),
+			Hedger:  &Hedger{Delay: FixedHedgeDelay(10 * time.Millisecond)},
+		},
+	}
+
+	res, err := client.Get(server.URL)
+	assert.NoError(err)
+
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal("fast ", string(body))
+	assert.Equal(int32(2), atomic.LoadInt32(count))
+}
+
+func TestPercentileHedgeDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	d := PercentileHedgeDelay(0.9, 10, time.Second)
+
+	for i := 1; i < 10; i++ {
+		d.Observe(time.Duration(i) * time.Millisecond)
+	}
+	// not enough latencies
+	assert.Equal(time.Second, d.Delay())
+
+	d.Observe(10 * time.Millisecond)
+	assert.Equal(10*time.Millisecond, d.Delay())
+
+	// oldest latencies are replaced
+	for i := 0; i < 9; i++ {
+		d.Observe(time.Millisecond)
+	}
+	assert.Equal(10*time.Millisecond, d.Delay())
+	d.Observe(time.Millisecond)
+	assert.Equal(time.Millisecond, d.Delay())
+}
@@ -0,0 +1,109 @@
+package retry
+
+import (
+	"context"
+	"time"
+
+	httpctx "github.com/fchoquet/golibs/http/ctx"
+	"github.com/fchoquet/golibs/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// default metrics values. Feel free to override in your project
+var (
+	RetryRetried         = "retry.retried"
+	RetryCompleted       = "retry.completed"
+	RetryAttempts        = "retry.attempts"
+	RetryTime            = "retry.time"
+	RetryBudgetExhausted = "retry.budget_exhausted"
+)
+
+// AttemptHook is called after a failed attempt, before waiting for the next one
+type AttemptHook func(ctx context.Context, attempt Attempt, wait time.Duration)
+
+// ResultHook is called at the end of a retry sequence
+type ResultHook func(ctx context.Context, res *Result)
+
+// OnRetry registers a hook called before every retry
+func OnRetry(hook AttemptHook) Option {
+	return func(r *retrier) {
+		r.onRetry = append(r.onRetry, hook)
+	}
+}
+
+// OnGiveUp registers a hook called when a retry sequence fails
+func OnGiveUp(hook ResultHook) Option {
+	return func(r *retrier) {
+		r.onGiveUp = append(r.onGiveUp, hook)
+	}
+}
+
+// OnSuccess registers a hook called when a retry sequence succeeds
+func OnSuccess(hook ResultHook) Option {
+	return func(r *retrier) {
+		r.onSuccess = append(r.onSuccess, hook)
+	}
+}
+
+// Log logs retries and final results of the operation
+// The contextualized logger (see http/ctx) is used when available, defaultLogger otherwise
+func Log(defaultLogger log.FieldLogger, operation string) Option {
+	getLogger := func(ctx context.Context) log.FieldLogger {
+		logger, ok := httpctx.Logger(ctx)
+		if !ok {
+			logger = defaultLogger
+		}
+		return logger.WithField("operation", operation)
+	}
+
+	return func(r *retrier) {
+		OnRetry(func(ctx context.Context, attempt Attempt, wait time.Duration) {
+			getLogger(ctx).WithFields(log.Fields{
+				"attempt": attempt.Number,
+				"wait":    wait.String(),
+			}).WithError(attempt.Err).Warnf("%s failed, retrying", operation)
+		})(r)
+
+		OnGiveUp(func(ctx context.Context, res *Result) {
+			getLogger(ctx).WithFields(log.Fields{
+				"attempts": len(res.Attempts),
+				"outcome":  res.Outcome,
+				"elapsed":  res.Elapsed.String(),
+			}).WithError(res.Err()).Errorf("%s failed, giving up", operation)
+		})(r)
+
+		OnSuccess(func(ctx context.Context, res *Result) {
+			getLogger(ctx).WithFields(log.Fields{
+				"attempts": len(res.Attempts),
+				"elapsed":  res.Elapsed.String(),
+			}).Debugf("%s succeeded", operation)
+		})(r)
+	}
+}
+
+// Metrics sends metrics about retries and final results of the operation
+// Metrics are tagged with the operation name and, at the end of the sequence, with its outcome.
+// RetryTime is the elapsed time of the whole sequence, sent as a histogram in milliseconds
+// RetryBudgetExhausted is also incremented when the retry budget gives up
+func Metrics(client metrics.Client, operation string) Option {
+	m := client.WithTag("operation:" + operation)
+
+	return func(r *retrier) {
+		completed := func(ctx context.Context, res *Result) {
+			m := m.WithTag("outcome:" + string(res.Outcome))
+			m.Incr(RetryCompleted)
+			m.Histogram(RetryAttempts, float64(len(res.Attempts)))
+			m.Histogram(RetryTime, float64(res.Elapsed)/float64(time.Millisecond))
+
+			if res.Outcome == BudgetExhausted {
+				m.Incr(RetryBudgetExhausted)
+			}
+		}
+
+		OnRetry(func(ctx context.Context, attempt Attempt, wait time.Duration) {
+			m.Incr(RetryRetried)
+		})(r)
+		OnGiveUp(completed)(r)
+		OnSuccess(completed)(r)
+	}
+}
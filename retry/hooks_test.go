@@ -0,0 +1,95 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	httpctx "github.com/fchoquet/golibs/http/ctx"
+	"github.com/fchoquet/golibs/metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	var retries []int
+	var giveUps, successes int
+
+	r := New(3, TestBackoff,
+		OnRetry(func(ctx context.Context, attempt Attempt, wait time.Duration) {
+			retries = append(retries, attempt.Number)
+		}),
+		OnGiveUp(func(ctx context.Context, res *Result) {
+			giveUps++
+		}),
+		OnSuccess(func(ctx context.Context, res *Result) {
+			successes++
+		}),
+	)
+
+	r.Retry(func(attempt int) (error, bool) {
+		return errors.New("failed"), true
+	})
+	assert.Equal([]int{1, 2}, retries)
+	assert.Equal(1, giveUps)
+	assert.Equal(0, successes)
+
+	r.Retry(func(attempt int) (error, bool) {
+		return nil, false
+	})
+	assert.Equal(1, giveUps)
+	assert.Equal(1, successes)
+}
+
+func TestLogHooksUseTheContextLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultLogger, defaultHook := test.NewNullLogger()
+	ctxLogger, ctxHook := test.NewNullLogger()
+
+	r := New(2, TestBackoff, Log(defaultLogger, "call_api"))
+	do := func(ctx context.Context, attempt int) (error, bool) {
+		return errors.New("failed"), true
+	}
+
+	r.RetryContext(context.Background(), do)
+	assert.Len(defaultHook.AllEntries(), 2)
+	assert.Equal(log.WarnLevel, defaultHook.AllEntries()[0].Level)
+	assert.Equal("call_api", defaultHook.AllEntries()[0].Data["operation"])
+	assert.Equal(log.ErrorLevel, defaultHook.LastEntry().Level)
+
+	r.RetryContext(httpctx.WithLogger(context.Background(), ctxLogger), do)
+	assert.Len(defaultHook.AllEntries(), 2)
+	assert.Len(ctxHook.AllEntries(), 2)
+}
+
+func TestMetricsHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	// the elapsed time is measured by the retrier, whatever the clock of the metrics client
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	client := metrics.NewRecorder(clock.New())
+	r := New(3, func(i int) time.Duration { return 0 }, Metrics(client, "call_api"), WithClock(c))
+
+	r.Retry(func(attempt int) (error, bool) {
+		c.Advance(time.Second)
+		if attempt < 3 {
+			return errors.New("failed"), true
+		}
+		return nil, false
+	})
+
+	assert.Equal([]string{
+		"retry.retried [operation:call_api]",
+		"retry.retried [operation:call_api]",
+		"retry.completed [operation:call_api outcome:success]",
+		"retry.attempts [operation:call_api outcome:success]",
+		"retry.time [operation:call_api outcome:success]",
+	}, client.Calls())
+	assert.Equal([]float64{3000}, client.Values("retry.time"))
+}
@@ -0,0 +1,96 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Policy classifies the result of an http attempt
+// res is nil when err, a transport error, is not
+type Policy interface {
+	// Classify returns ok = true if the attempt succeeded. Otherwise retry states if it can be retried
+	Classify(req *http.Request, res *http.Response, err error) (ok bool, retry bool)
+}
+
+// PolicyFunc is an adapter to use ordinary functions as Policy
+type PolicyFunc func(req *http.Request, res *http.Response, err error) (ok bool, retry bool)
+
+// Classify calls f(req, res, err)
+func (f PolicyFunc) Classify(req *http.Request, res *http.Response, err error) (bool, bool) {
+	return f(req, res, err)
+}
+
+// DefaultRetryPolicy is used when no policy is defined in the request context. Feel free to override in your project
+// All 2xx statuses are successes. 408, 429, 502, 503 and 504 statuses are retried.
+// Idempotent requests are retried on timeouts and connection errors
+var DefaultRetryPolicy Policy = PolicyFunc(defaultRetryPolicy)
+
+func defaultRetryPolicy(req *http.Request, res *http.Response, err error) (bool, bool) {
+	if err != nil {
+		return false, isIdempotent(req) && isTransientNetworkError(err)
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return true, false
+	}
+
+	switch res.StatusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return false, true
+	}
+
+	return false, false
+}
+
+type contextKey int
+
+// policyKey contains the Policy of a request
+const policyKey contextKey = 1
+
+// WithRetryPolicy returns a new context containing a Policy
+// Use it to customize the policy of a single request
+func WithRetryPolicy(ctx context.Context, policy Policy) context.Context {
+	return context.WithValue(ctx, policyKey, policy)
+}
+
+// retryPolicy returns the policy stored in the context or the default one
+func retryPolicy(ctx context.Context) Policy {
+	if policy, ok := ctx.Value(policyKey).(Policy); ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
+
+// isIdempotent states if a request can be safely sent twice
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	// same convention as the standard library transport
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
+
+// isTransientNetworkError states if a transport error is likely to disappear on the next attempt
+func isTransientNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,100 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	get, _ := http.NewRequest("GET", "http://example.com", nil)
+	post, _ := http.NewRequest("POST", "http://example.com", nil)
+	idempotentPost, _ := http.NewRequest("POST", "http://example.com", nil)
+	idempotentPost.Header.Set("Idempotency-Key", "123")
+
+	fixtures := []struct {
+		name  string
+		req   *http.Request
+		res   *http.Response
+		err   error
+		ok    bool
+		retry bool
+	}{
+		{"200", get, &http.Response{StatusCode: 200}, nil, true, false},
+		{"204", get, &http.Response{StatusCode: 204}, nil, true, false},
+		{"304", get, &http.Response{StatusCode: 304}, nil, false, false},
+		{"400", get, &http.Response{StatusCode: 400}, nil, false, false},
+		{"408", get, &http.Response{StatusCode: 408}, nil, false, true},
+		{"429", post, &http.Response{StatusCode: 429}, nil, false, true},
+		{"500", get, &http.Response{StatusCode: 500}, nil, false, false},
+		{"501", get, &http.Response{StatusCode: 501}, nil, false, false},
+		{"502", get, &http.Response{StatusCode: 502}, nil, false, true},
+		{"503", post, &http.Response{StatusCode: 503}, nil, false, true},
+		{"504", get, &http.Response{StatusCode: 504}, nil, false, true},
+		{"GET timeout", get, nil, timeoutError{}, false, true},
+		{"GET reset", get, nil, syscall.ECONNRESET, false, true},
+		{"GET EOF", get, nil, io.EOF, false, true},
+		{"GET other error", get, nil, errors.New("invalid url"), false, false},
+		{"POST reset", post, nil, syscall.ECONNRESET, false, false},
+		{"POST reset with idempotency key", idempotentPost, nil, syscall.ECONNRESET, false, true},
+	}
+
+	for _, fixture := range fixtures {
+		ok, retry := DefaultRetryPolicy.Classify(fixture.req, fixture.res, fixture.err)
+		assert.Equal(fixture.ok, ok, fixture.name)
+		assert.Equal(fixture.retry, retry, fixture.name)
+	}
+}
+
+func TestSendHTTPRequestUsesThePolicyFromTheContext(t *testing.T) {
+	assert := assert.New(t)
+
+	body := ioutil.NopCloser(strings.NewReader("blah"))
+	httpClient := &mockHTTPDoer{}
+	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 500, Body: body}, nil).Twice()
+	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 404, Body: body}, nil).Once()
+
+	// let's say that 500 can be retried and 404 is fine
+	policy := PolicyFunc(func(req *http.Request, res *http.Response, err error) (bool, bool) {
+		return res.StatusCode == 404, res.StatusCode == 500
+	})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req = req.WithContext(WithRetryPolicy(context.Background(), policy))
+
+	res, err := SendHTTPRequest(New(3, TestBackoff), httpClient, req)
+
+	assert.Nil(err)
+	assert.Equal(404, res.StatusCode)
+	httpClient.AssertNumberOfCalls(t, "Do", 3)
+}
+
+func TestSendHTTPRequestDoesNotRetryNotImplemented(t *testing.T) {
+	assert := assert.New(t)
+
+	body := ioutil.NopCloser(strings.NewReader("blah"))
+	httpClient := &mockHTTPDoer{}
+	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 501, Body: body}, nil).Once()
+
+	res, err := SendHTTPRequest(New(3, TestBackoff), httpClient, &http.Request{})
+
+	assert.NotNil(err)
+	assert.Equal(501, res.StatusCode)
+	httpClient.AssertNumberOfCalls(t, "Do", 1)
+}
@@ -0,0 +1,104 @@
+package retry
+
+import (
+	"fmt"
+	"time"
+)
+
+// Outcome states why a retrier stopped
+type Outcome string
+
+// Possible outcomes
+const (
+	// Succeeded means the last attempt was successful
+	Succeeded Outcome = "success"
+	// MaxAttemptsReached means every allowed attempt failed
+	MaxAttemptsReached Outcome = "max_attempts"
+	// NotRetryable means the retrier gave up because the last error could not be retried
+	NotRetryable Outcome = "not_retryable"
+	// BudgetExhausted means the retry budget did not allow another attempt (see WithBudget)
+	BudgetExhausted Outcome = "budget_exhausted"
+	// ContextDone means the context was cancelled or its deadline would have been exceeded
+	ContextDone Outcome = "context_done"
+)
+
+// Attempt describes a single attempt
+type Attempt struct {
+	Number   int
+	Err      error
+	Duration time.Duration
+}
+
+// Result describes a whole retry sequence
+type Result struct {
+	Attempts []Attempt
+	Outcome  Outcome
+	// Elapsed is the total time spent, back off waits included
+	Elapsed time.Duration
+	// Slept is the time spent waiting between attempts
+	Slept time.Duration
+	// ContextErr is the context error when Outcome is ContextDone
+	ContextErr error
+}
+
+// LastErr returns the error of the last attempt (nil if it succeeded or if no attempt was made)
+func (r *Result) LastErr() error {
+	if len(r.Attempts) == 0 {
+		return nil
+	}
+	return r.Attempts[len(r.Attempts)-1].Err
+}
+
+// Err returns nil if the sequence succeeded, an *Error aggregating all the errors otherwise
+func (r *Result) Err() error {
+	if r.Outcome == Succeeded {
+		return nil
+	}
+
+	e := &Error{
+		Outcome:    r.Outcome,
+		ContextErr: r.ContextErr,
+	}
+	for _, a := range r.Attempts {
+		e.Errors = append(e.Errors, a.Err)
+	}
+	return e
+}
+
+// Error aggregates the errors of a failed retry sequence
+// errors.Is and errors.As match any of the attempt errors and the context error
+type Error struct {
+	Outcome Outcome
+	// Errors contains the error of each attempt, in order
+	Errors     []error
+	ContextErr error
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		if e.ContextErr == nil {
+			return fmt.Sprintf("%s: no attempt was made", e.Outcome)
+		}
+		return fmt.Sprintf("%s before the first attempt: %s", e.Outcome, e.ContextErr)
+	}
+
+	msg := fmt.Sprintf("%s after %d attempt(s): %s", e.Outcome, len(e.Errors), e.Errors[len(e.Errors)-1])
+	if e.ContextErr != nil {
+		msg += fmt.Sprintf(" (%s)", e.ContextErr)
+	}
+	return msg
+}
+
+// Unwrap makes errors.Is and errors.As work with all the wrapped errors
+func (e *Error) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors)+1)
+	if e.ContextErr != nil {
+		errs = append(errs, e.ContextErr)
+	}
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,92 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type customError struct {
+	code int
+}
+
+func (e customError) Error() string {
+	return fmt.Sprintf("custom error %d", e.code)
+}
+
+func TestRetryWithResultWhenEventuallySuccessful(t *testing.T) {
+	assert := assert.New(t)
+
+	res := New(5, TestBackoff).RetryWithResult(context.Background(), func(ctx context.Context, attempt int) (error, bool) {
+		if attempt < 3 {
+			return fmt.Errorf("Error on attempt #%d", attempt), true
+		}
+		return nil, false
+	})
+
+	assert.Equal(Succeeded, res.Outcome)
+	assert.Len(res.Attempts, 3)
+	assert.Equal("Error on attempt #1", res.Attempts[0].Err.Error())
+	assert.Equal("Error on attempt #2", res.Attempts[1].Err.Error())
+	assert.Nil(res.Attempts[2].Err)
+	assert.Equal(3, res.Attempts[2].Number)
+	assert.True(res.Elapsed >= res.Slept)
+	assert.Nil(res.LastErr())
+	assert.Nil(res.Err())
+}
+
+func TestRetryWithResultWhenMaxAttemptsAreReached(t *testing.T) {
+	assert := assert.New(t)
+
+	res := New(3, TestBackoff).RetryWithResult(context.Background(), func(ctx context.Context, attempt int) (error, bool) {
+		return customError{attempt}, true
+	})
+
+	assert.Equal(MaxAttemptsReached, res.Outcome)
+	assert.Len(res.Attempts, 3)
+
+	err := res.Err()
+	assert.Equal("max_attempts after 3 attempt(s): custom error 3", err.Error())
+
+	var retryErr *Error
+	assert.True(errors.As(err, &retryErr))
+	assert.Len(retryErr.Errors, 3)
+
+	// errors.Is and errors.As see every attempt error
+	assert.True(errors.Is(err, customError{1}))
+	assert.True(errors.Is(err, customError{2}))
+	var custom customError
+	assert.True(errors.As(err, &custom))
+}
+
+func TestRetryWithResultWhenNotRetryable(t *testing.T) {
+	assert := assert.New(t)
+
+	res := New(3, TestBackoff).RetryWithResult(context.Background(), func(ctx context.Context, attempt int) (error, bool) {
+		return customError{attempt}, false
+	})
+
+	assert.Equal(NotRetryable, res.Outcome)
+	assert.Len(res.Attempts, 1)
+	assert.Equal(customError{1}, res.LastErr())
+}
+
+func TestRetryWithResultWhenContextIsDone(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	res := New(3, TestBackoff).RetryWithResult(ctx, func(ctx context.Context, attempt int) (error, bool) {
+		cancel()
+		return customError{attempt}, true
+	})
+
+	assert.Equal(ContextDone, res.Outcome)
+	assert.Len(res.Attempts, 1)
+	assert.Equal(context.Canceled, res.ContextErr)
+	assert.True(errors.Is(res.Err(), context.Canceled))
+	assert.True(errors.Is(res.Err(), customError{1}))
+}
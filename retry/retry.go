@@ -2,10 +2,14 @@ package retry
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"time"
+
+	"github.com/fchoquet/golibs/clock"
 )
 
 // BackOffFunc return the time before the next attempt
@@ -16,8 +20,13 @@ type BackOffFunc func(i int) time.Duration
 // AttemptFunc is the closure called at every attempt.
 // In case of error it states if a retry is possible or if we should give up
 // For instance when calling an Http Api, a 504 should be retried, not a 400
+// See Do for an alternative returning a value
 type AttemptFunc func(attempt int) (err error, retry bool)
 
+// ContextAttemptFunc is the context-aware version of AttemptFunc
+// It receives the context passed to RetryContext
+type ContextAttemptFunc func(ctx context.Context, attempt int) (err error, retry bool)
+
 // Retrier retries an AttemptFunc and return the final results
 // This is the implementer's responsibility to limit the number of attempts
 // And use an appropriate back off strategy
@@ -25,65 +34,325 @@ type Retrier interface {
 	Retry(do AttemptFunc) error
 }
 
+// ContextRetrier is a Retrier supporting contexts and reporting every attempt
+// The Retrier returned by New implements it. See WithContext to adapt other Retriers
+type ContextRetrier interface {
+	Retrier
+	// RetryContext is similar to Retry but gives up as soon as ctx is done
+	// It never starts an attempt that would begin after the context deadline
+	RetryContext(ctx context.Context, do ContextAttemptFunc) error
+	// RetryWithResult is similar to RetryContext but reports every attempt
+	// Call Err on the result to get an error aggregating all the attempt errors
+	RetryWithResult(ctx context.Context, do ContextAttemptFunc) *Result
+}
+
+// WithContext returns r as a ContextRetrier
+// Retriers that do not implement ContextRetrier are adapted: no attempt is started once ctx is done,
+// but waiting between attempts cannot be interrupted
+func WithContext(r Retrier) ContextRetrier {
+	if cr, ok := r.(ContextRetrier); ok {
+		return cr
+	}
+	return &contextAdapter{Retrier: r}
+}
+
+// contextAdapter adds context support to a Retrier
+// Its results are measured with the wall clock since the Retrier does not expose any
+type contextAdapter struct {
+	Retrier
+}
+
+func (a *contextAdapter) RetryContext(ctx context.Context, do ContextAttemptFunc) error {
+	return contextErr(a.RetryWithResult(ctx, do))
+}
+
+func (a *contextAdapter) RetryWithResult(ctx context.Context, do ContextAttemptFunc) *Result {
+	start := time.Now()
+	res := &Result{
+		Outcome: MaxAttemptsReached,
+	}
+
+	a.Retrier.Retry(func(attempt int) (error, bool) {
+		if err := ctx.Err(); err != nil {
+			res.Outcome, res.ContextErr = ContextDone, err
+			return err, false
+		}
+
+		attemptStart := time.Now()
+		err, retry := do(ctx, attempt)
+		res.Attempts = append(res.Attempts, Attempt{
+			Number:   attempt,
+			Err:      err,
+			Duration: time.Since(attemptStart),
+		})
+
+		switch {
+		case err == nil:
+			res.Outcome = Succeeded
+		case !retry:
+			res.Outcome = NotRetryable
+		default:
+			res.Outcome = MaxAttemptsReached
+		}
+		return err, retry
+	})
+
+	res.Elapsed = time.Since(start)
+	return res
+}
+
+// contextErr returns the error RetryContext returns for res
+func contextErr(res *Result) error {
+	if res.Outcome == ContextDone {
+		return &ContextError{Err: res.ContextErr, LastErr: res.LastErr()}
+	}
+	return res.LastErr()
+}
+
+// ContextError is returned by RetryContext when the context is done before the end of the retries
+// It wraps both the context error and the error returned by the last attempt (if any)
+type ContextError struct {
+	Err     error
+	LastErr error
+}
+
+func (e *ContextError) Error() string {
+	if e.LastErr == nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (last error: %s)", e.Err, e.LastErr)
+}
+
+// Unwrap makes errors.Is and errors.As work with both wrapped errors
+func (e *ContextError) Unwrap() []error {
+	if e.LastErr == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.LastErr}
+}
+
+// Option customizes the default Retrier implementation
+type Option func(r *retrier)
+
+// WithClock sets the clock used to measure and wait. Use a fake clock in tests
+func WithClock(c clock.Clock) Option {
+	return func(r *retrier) {
+		r.clock = c
+	}
+}
+
 // New returns a default Retrier implementation
-func New(maxAttempts int, backoff BackOffFunc) Retrier {
-	return &retrier{
-		maxAttempts: maxAttempts,
-		backoff:     backoff,
+func New(maxAttempts int, backoff BackOffFunc, options ...Option) ContextRetrier {
+	r := &retrier{
+		maxAttempts:   maxAttempts,
+		backoff:       backoff,
+		maxRetryAfter: DefaultMaxRetryAfter,
+		clock:         clock.New(),
+	}
+
+	for _, option := range options {
+		option(r)
 	}
+
+	return r
 }
 
 type retrier struct {
-	maxAttempts int
-	backoff     BackOffFunc
+	maxAttempts   int
+	backoff       BackOffFunc
+	maxRetryAfter time.Duration
+	budget        Budget
+	timeout       func(attempt int) time.Duration
+	clock         clock.Clock
+	onRetry       []AttemptHook
+	onGiveUp      []ResultHook
+	onSuccess     []ResultHook
 }
 
 func (r *retrier) Retry(do AttemptFunc) error {
-	var lastErr error
+	return r.RetryContext(context.Background(), func(_ context.Context, attempt int) (error, bool) {
+		return do(attempt)
+	})
+}
+
+func (r *retrier) RetryContext(ctx context.Context, do ContextAttemptFunc) error {
+	return contextErr(r.RetryWithResult(ctx, do))
+}
+
+func (r *retrier) RetryWithResult(ctx context.Context, do ContextAttemptFunc) *Result {
+	start := r.clock.Now()
+	res := &Result{
+		Outcome: MaxAttemptsReached,
+	}
+
+	if r.budget != nil {
+		r.budget.Deposit()
+	}
 
 	for i := 0; i < r.maxAttempts; i++ {
 		if i > 0 {
-			time.Sleep(r.backoff(i))
+			if r.budget != nil && !r.budget.Withdraw() {
+				res.Outcome = BudgetExhausted
+				break
+			}
+
+			wait := r.wait(i, res.LastErr())
+			for _, hook := range r.onRetry {
+				hook(ctx, res.Attempts[i-1], wait)
+			}
+
+			if err := r.sleep(ctx, wait); err != nil {
+				res.Outcome, res.ContextErr = ContextDone, err
+				break
+			}
+			res.Slept += wait
+		}
+
+		if err := ctx.Err(); err != nil {
+			res.Outcome, res.ContextErr = ContextDone, err
+			break
 		}
 
-		var retry bool
-		lastErr, retry = do(i + 1)
+		attemptStart := r.clock.Now()
+		attemptCtx, release := r.attemptContext(ctx, i+1)
+		err, retry := do(attemptCtx, i+1)
+		release()
+
+		res.Attempts = append(res.Attempts, Attempt{
+			Number:   i + 1,
+			Err:      err,
+			Duration: r.clock.Since(attemptStart),
+		})
 
-		if lastErr == nil || !retry {
-			// no error or no retry
+		if err == nil {
+			res.Outcome = Succeeded
 			break
 		}
+		if !retry {
+			res.Outcome = NotRetryable
+			break
+		}
+	}
+
+	res.Elapsed = r.clock.Since(start)
+
+	hooks := r.onGiveUp
+	if res.Outcome == Succeeded {
+		hooks = r.onSuccess
+	}
+	for _, hook := range hooks {
+		hook(ctx, res)
+	}
+
+	return res
+}
+
+// attemptContext derives the context of a single attempt from the context of the sequence
+// The returned func releases the context once the attempt returned, unless the attempt kept it (see keepAttemptContext)
+func (r *retrier) attemptContext(ctx context.Context, attempt int) (context.Context, func()) {
+	if r.timeout == nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout(attempt))
+	owner := &attemptOwner{cancel: cancel}
+	return context.WithValue(ctx, attemptKey{}, owner), owner.release
+}
+
+// wait returns the time to wait before the next attempt
+// The delay requested by the last error (see After) takes precedence over the back off strategy
+func (r *retrier) wait(i int, lastErr error) time.Duration {
+	if d, ok := retryAfterDelay(lastErr); ok {
+		if d > r.maxRetryAfter {
+			return r.maxRetryAfter
+		}
+		return d
+	}
+	return r.backoff(i)
+}
+
+// sleep waits for d unless ctx is done first
+// It returns immediately if the context deadline would be exceeded before the end of the wait
+func (r *retrier) sleep(ctx context.Context, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && r.clock.Now().Add(d).After(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	timer := r.clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MaxErrorBodySize is the maximum number of bytes of a response body kept in an HTTPError
+var MaxErrorBodySize int64 = 64 << 10
+
+// HTTPError is returned by SendHTTPRequest when the last response has a failed status
+type HTTPError struct {
+	StatusCode int
+	Header     http.Header
+	// Body contains the beginning of the response body, up to MaxErrorBodySize bytes
+	Body []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("http error %d : %s", e.StatusCode, e.Body)
+}
+
+// newHTTPError reads a bounded snapshot of a failed response body then closes it
+// The response body is replaced with the snapshot so that it can still be read
+func newHTTPError(res *http.Response) *HTTPError {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, MaxErrorBodySize))
+	drainAndClose(res.Body)
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return &HTTPError{
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
 	}
-	return lastErr
 }
 
 // SendHTTPRequest sends an http request using the provided Retrier
-func SendHTTPRequest(r Retrier, client httpDoer, req *http.Request) (res *http.Response, err error) {
+// Retries stop as soon as the request context is done (see WithContext for Retriers not implementing ContextRetrier)
+// Attempts are classified by the Policy stored in the request context (see WithRetryPolicy), or by DefaultRetryPolicy.
+// When the server states when to retry (Retry-After or X-RateLimit-Reset headers)
+// this delay is used instead of the Retrier's back off strategy
+// A failed status results in an *HTTPError. The body of failed responses is closed and replaced with its snapshot
+func SendHTTPRequest(r Retrier, client httpDoer, req *http.Request) (*http.Response, error) {
+	policy := retryPolicy(req.Context())
 
-	err = r.Retry(func(attempt int) (err error, retry bool) {
+	return Do(req.Context(), r, func(ctx context.Context, attempt int) (*http.Response, error) {
 		// req.Body is consumed when we call Do. Let's use a clone
-		newReq, err1 := cloneRequest(req)
-		if err1 != nil {
-			return err1, false
+		newReq, err := cloneRequest(req)
+		if err != nil {
+			return nil, Permanent(err)
 		}
+		// the attempt context carries the attempt timeout if any
+		newReq = newReq.WithContext(ctx)
+
+		res, err := client.Do(newReq)
 
-		res, err = client.Do(newReq)
+		ok, retry := policy.Classify(newReq, res, err)
 		if err != nil {
-			return err, true
+			return res, mark(err, retry)
+		}
+		if ok {
+			// the body is read by the caller after the attempt returned
+			res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: keepAttemptContext(ctx)}
+			return res, nil
 		}
 
-		if res.StatusCode != 200 && res.StatusCode != 201 && res.StatusCode != 202 {
-			body, _ := ioutil.ReadAll(res.Body)
-			// Will not retry 4xx statuses but will retry 5xx
-			if res.StatusCode >= 500 {
-				retry = true
-			}
-			err = fmt.Errorf("http error %d : %s", res.StatusCode, body)
+		err = newHTTPError(res)
+		if d, ok := retryAfterHeader(res.Header, time.Now()); ok && retry {
+			err = After(err, d)
 		}
-		return
+		return res, mark(err, retry)
 	})
-
-	return
 }
 
 // clone an http request and preserves body
@@ -1,13 +1,16 @@
 package retry
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/fchoquet/golibs/clock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -64,13 +67,157 @@ func TestRetryWhenNoPossibleRetry(t *testing.T) {
 	assert.Equal("Error on attempt #1", err.Error())
 }
 
+func TestRetryContextStopsWhenContextIsCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	r := New(3, func(i int) time.Duration {
+		return time.Hour
+	}, WithClock(c))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attemptErr := errors.New("attempt failed")
+
+	calls := 0
+	go func() {
+		// cancel while the retrier waits before the second attempt
+		c.BlockUntil(1)
+		cancel()
+	}()
+
+	err := r.RetryContext(ctx, func(ctx context.Context, attempt int) (error, bool) {
+		calls++
+		return attemptErr, true
+	})
+
+	assert.Equal(1, calls)
+	assert.True(errors.Is(err, context.Canceled))
+	assert.True(errors.Is(err, attemptErr))
+}
+
+func TestRetryContextDoesNotStartAnAttemptAfterTheDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	r := New(3, func(i int) time.Duration {
+		return time.Hour
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := r.RetryContext(ctx, func(ctx context.Context, attempt int) (error, bool) {
+		calls++
+		return errors.New("attempt failed"), true
+	})
+
+	assert.Equal(1, calls)
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	// it gave up without waiting
+	assert.True(time.Since(start) < time.Second)
+}
+
+func TestRetryContextWhenContextIsAlreadyDone(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := New(3, TestBackoff).RetryContext(ctx, func(ctx context.Context, attempt int) (error, bool) {
+		calls++
+		return nil, false
+	})
+
+	assert.Equal(0, calls)
+	assert.Equal(context.Canceled.Error(), err.Error())
+}
+
+func TestRetryWithAFakeClock(t *testing.T) {
+	assert := assert.New(t)
+
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	r := New(3, Constant(time.Hour), WithClock(c))
+
+	done := make(chan *Result)
+	go func() {
+		done <- r.RetryWithResult(context.Background(), func(ctx context.Context, attempt int) (error, bool) {
+			return errors.New("failed"), true
+		})
+	}()
+
+	// the retrier waits for an hour between attempts
+	c.BlockUntil(1)
+	c.Advance(time.Hour)
+	c.BlockUntil(1)
+	c.Advance(time.Hour)
+
+	res := <-done
+	assert.Len(res.Attempts, 3)
+	assert.Equal(2*time.Hour, res.Slept)
+	assert.Equal(2*time.Hour, res.Elapsed)
+}
+
+// loopRetrier is a minimal Retrier that does not implement ContextRetrier
+type loopRetrier struct {
+	maxAttempts int
+}
+
+func (r loopRetrier) Retry(do AttemptFunc) error {
+	var err error
+	for i := 1; i <= r.maxAttempts; i++ {
+		var retry bool
+		if err, retry = do(i); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func TestWithContextAdaptsAPlainRetrier(t *testing.T) {
+	assert := assert.New(t)
+
+	r := WithContext(loopRetrier{maxAttempts: 3})
+	res := r.RetryWithResult(context.Background(), func(ctx context.Context, attempt int) (error, bool) {
+		if attempt < 2 {
+			return errors.New("failed"), true
+		}
+		return nil, false
+	})
+
+	assert.Equal(Succeeded, res.Outcome)
+	assert.Len(res.Attempts, 2)
+	assert.Nil(res.Err())
+}
+
+func TestWithContextStopsAPlainRetrierWhenContextIsCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := WithContext(loopRetrier{maxAttempts: 3}).RetryContext(ctx, func(ctx context.Context, attempt int) (error, bool) {
+		calls++
+		cancel()
+		return errors.New("failed"), true
+	})
+
+	assert.Equal(1, calls)
+	assert.True(errors.Is(err, context.Canceled))
+}
+
+func TestWithContextReturnsAContextRetrierUnchanged(t *testing.T) {
+	r := New(3, TestBackoff)
+	assert.Equal(t, r, WithContext(r))
+}
+
 func TestSendHTTPRequestWhenItEventuallySucceeds(t *testing.T) {
 	assert := assert.New(t)
 
-	// this client will fail twice with a 500 error then will succeed
+	// this client will fail twice with a 503 error then will succeed
 	body := ioutil.NopCloser(strings.NewReader("blah"))
 	httpClient := &mockHTTPDoer{}
-	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 500, Body: body}, nil).Twice()
+	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 503, Body: body}, nil).Twice()
 	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 200, Body: body}, nil).Once()
 
 	r := New(3, TestBackoff)
@@ -86,14 +233,14 @@ func TestSendHTTPRequestWhenItEventuallyFails(t *testing.T) {
 
 	body := ioutil.NopCloser(strings.NewReader("blah"))
 	httpClient := &mockHTTPDoer{}
-	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 500, Body: body}, nil).Times(3)
+	httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 503, Body: body}, nil).Times(3)
 
 	r := New(3, TestBackoff)
 
 	res, err := SendHTTPRequest(r, httpClient, &http.Request{})
 
 	assert.NotNil(err)
-	assert.Equal(500, res.StatusCode)
+	assert.Equal(503, res.StatusCode)
 }
 
 func TestSendHTTPRequestDoesNotRetryInCaseOf400Status(t *testing.T) {
@@ -147,6 +294,38 @@ func TestBodyReaderIsStillReadeableAfterAFailedAttempt(t *testing.T) {
 	assert.Equal([]byte("blah"), finalBody)
 }
 
+func TestSendHTTPRequestReturnsAnHTTPError(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(max int64) { MaxErrorBodySize = max }(MaxErrorBodySize)
+	MaxErrorBodySize = 5
+
+	var bodies []*closeRecorder
+	httpClient := &mockHTTPDoer{}
+	for i := 0; i < 2; i++ {
+		body := &closeRecorder{Reader: strings.NewReader("unavailable")}
+		bodies = append(bodies, body)
+		header := http.Header{}
+		header.Set("X-Request-Id", "123")
+		httpClient.On("Do", mock.Anything).Return(&http.Response{StatusCode: 503, Header: header, Body: body}, nil).Once()
+	}
+
+	res, err := SendHTTPRequest(New(2, TestBackoff), httpClient, &http.Request{})
+
+	var httpErr *HTTPError
+	assert.True(errors.As(err, &httpErr))
+	assert.Equal(503, httpErr.StatusCode)
+	assert.Equal("123", httpErr.Header.Get("X-Request-Id"))
+	assert.Equal([]byte("unava"), httpErr.Body)
+	assert.Equal("http error 503 : unava", err.Error())
+
+	// all the bodies are closed but the snapshot can still be read
+	assert.True(bodies[0].closed)
+	assert.True(bodies[1].closed)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal([]byte("unava"), body)
+}
+
 type mockHTTPDoer struct {
 	mock.Mock
 }
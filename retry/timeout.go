@@ -0,0 +1,51 @@
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+// AttemptTimeout gives every attempt its own context with a timeout
+// Like any failed attempt, an attempt that times out is retried only if it reports its error as retryable:
+// SendHTTPRequest and Transport only retry timeouts of idempotent requests (see DefaultRetryPolicy).
+// The deadline of the context passed to the Retrier still applies.
+// Attempts started with Retry are not affected since they do not receive any context
+// With SendHTTPRequest and Transport, the timeout also applies to reading the body of the returned response
+func AttemptTimeout(d time.Duration) Option {
+	return GrowingAttemptTimeout(Constant(d))
+}
+
+// GrowingAttemptTimeout is similar to AttemptTimeout but the timeout depends on the attempt number (starting at 1)
+// A BackOffFunc like Exponential or Linear can be used to give more time to later attempts
+func GrowingAttemptTimeout(timeout func(attempt int) time.Duration) Option {
+	return func(r *retrier) {
+		r.timeout = timeout
+	}
+}
+
+// attemptKey is the context key of the attemptOwner of an attempt context
+type attemptKey struct{}
+
+// attemptOwner tells if the attempt context must be cancelled by the retrier when the attempt returns
+type attemptOwner struct {
+	cancel context.CancelFunc
+	kept   bool
+}
+
+func (o *attemptOwner) release() {
+	if !o.kept {
+		o.cancel()
+	}
+}
+
+// keepAttemptContext prevents the retrier from cancelling the attempt context when the attempt returns
+// It must be called before the attempt returns. The caller is then responsible for calling the returned func
+// This is needed when the result of an attempt still depends on its context, like the body of an http response
+func keepAttemptContext(ctx context.Context) context.CancelFunc {
+	owner, ok := ctx.Value(attemptKey{}).(*attemptOwner)
+	if !ok {
+		return func() {}
+	}
+	owner.kept = true
+	return owner.cancel
+}
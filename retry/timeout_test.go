@@ -0,0 +1,146 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttemptTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	r := New(3, TestBackoff, AttemptTimeout(10*time.Millisecond))
+
+	calls := 0
+	err := r.RetryContext(context.Background(), func(ctx context.Context, attempt int) (error, bool) {
+		calls++
+		if attempt == 1 {
+			// this attempt hangs until it times out
+			<-ctx.Done()
+			return ctx.Err(), true
+		}
+		return nil, false
+	})
+
+	assert.NoError(err)
+	assert.Equal(2, calls)
+}
+
+func TestGrowingAttemptTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	r := New(3, TestBackoff, GrowingAttemptTimeout(Linear(time.Second, 0)))
+
+	var timeouts []time.Duration
+	r.RetryContext(context.Background(), func(ctx context.Context, attempt int) (error, bool) {
+		deadline, ok := ctx.Deadline()
+		assert.True(ok)
+		timeouts = append(timeouts, time.Until(deadline).Round(time.Second))
+		return errors.New("failed"), true
+	})
+
+	assert.Equal([]time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, timeouts)
+}
+
+func TestAttemptTimeoutRespectsTheCallerDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	r := New(3, TestBackoff, AttemptTimeout(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	err := r.RetryContext(ctx, func(ctx context.Context, attempt int) (error, bool) {
+		calls++
+		<-ctx.Done()
+		return ctx.Err(), false
+	})
+
+	// the caller deadline is not an attempt timeout: no retry
+	assert.Equal(1, calls)
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestAttemptTimeoutWithSendHTTPRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// the first attempt hangs until the client gives up
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	r := New(3, TestBackoff, AttemptTimeout(50*time.Millisecond))
+	req, _ := http.NewRequest("GET", server.URL, nil)
+
+	res, err := SendHTTPRequest(r, server.Client(), req)
+
+	assert.NoError(err)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestAttemptTimeoutDoesNotRetryNonIdempotentRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// every attempt hangs until the client gives up
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	r := New(3, TestBackoff, AttemptTimeout(20*time.Millisecond))
+	req, _ := http.NewRequest("POST", server.URL, nil)
+
+	_, err := SendHTTPRequest(r, server.Client(), req)
+
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestAttemptTimeoutKeepsSuccessfulResponsesReadable(t *testing.T) {
+	assert := assert.New(t)
+
+	// the body is streamed so that it is still being read after the attempt returned
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	r := New(3, TestBackoff, AttemptTimeout(time.Second))
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	res, err := SendHTTPRequest(r, server.Client(), req)
+	assert.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.Equal("ok", string(body))
+
+	client := &http.Client{
+		Transport: &Transport{Retrier: r, Base: server.Client().Transport},
+	}
+	res, err = client.Get(server.URL)
+	assert.NoError(err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.Equal("ok", string(body))
+}
@@ -0,0 +1,176 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxBodyBuffer is the default maximum size of a request body buffered by Transport
+var DefaultMaxBodyBuffer int64 = 1 << 20
+
+// maxDrainSize is the maximum number of bytes read from a discarded response body
+// Draining a body lets the underlying connection be reused, but it is not worth reading huge bodies
+const maxDrainSize = 64 << 10
+
+// Transport is an http.RoundTripper retrying requests with a Retrier
+// It lets any http.Client benefit from retries:
+//
+//	client := &http.Client{
+//		Transport: &retry.Transport{Retrier: retry.New(3, retry.PowBackoff)},
+//	}
+//
+// Attempts are classified by the Policy stored in the request context, or by DefaultRetryPolicy.
+// Unlike SendHTTPRequest, a failed status is not an error: the last response is returned as is
+type Transport struct {
+	// Retrier retries the requests. Required
+	// Retriers not implementing ContextRetrier are adapted with WithContext
+	Retrier Retrier
+	// Base sends the requests. http.DefaultTransport is used if nil
+	Base http.RoundTripper
+	// MaxBodyBuffer is the maximum size of a request body buffered to be sent again when the request has no GetBody
+	// Requests with a bigger body are sent only once. DefaultMaxBodyBuffer is used if zero
+	MaxBodyBuffer int64
+	// Hedger hedges every attempt if not nil
+	Hedger *Hedger
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	getBody, body, err := t.rewindableBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if getBody == nil {
+		// the body cannot be sent twice. The caller's request must not be modified
+		onceReq := *req
+		onceReq.Body = body
+		return t.base().RoundTrip(&onceReq)
+	}
+
+	policy := retryPolicy(req.Context())
+
+	var res *http.Response
+	err = WithContext(t.Retrier).RetryContext(req.Context(), func(ctx context.Context, attempt int) (error, bool) {
+		if res != nil {
+			// the previous response is discarded
+			drainAndClose(res.Body)
+			res = nil
+		}
+
+		body, err := getBody()
+		if err != nil {
+			return err, false
+		}
+		attemptReq := req.Clone(ctx)
+		attemptReq.Body = body
+		attemptReq.GetBody = getBody
+
+		res, err = t.send(attemptReq)
+		if res != nil {
+			// the body may be read by the caller after the attempt returned
+			res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: keepAttemptContext(ctx)}
+		}
+
+		ok, retry := policy.Classify(attemptReq, res, err)
+		if err != nil {
+			return err, retry
+		}
+		if ok || !retry {
+			// the caller handles the response
+			return nil, false
+		}
+
+		// the body is kept for the caller in case it is the last response
+		err = &HTTPError{StatusCode: res.StatusCode, Header: res.Header}
+		if d, ok := retryAfterHeader(res.Header, time.Now()); ok {
+			err = After(err, d)
+		}
+		return err, true
+	})
+
+	if res == nil {
+		return nil, err
+	}
+
+	var ctxErr *ContextError
+	if errors.As(err, &ctxErr) {
+		drainAndClose(res.Body)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// send sends a single attempt, hedged if a Hedger is defined
+func (t *Transport) send(req *http.Request) (*http.Response, error) {
+	if t.Hedger != nil {
+		return t.Hedger.send(req, t.base().RoundTrip)
+	}
+	return t.base().RoundTrip(req)
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// rewindableBody returns a func providing a fresh copy of the request body for each attempt
+// It returns a nil func if the body cannot be read twice. In that case body must be sent once instead of req.Body
+func (t *Transport) rewindableBody(req *http.Request) (getBody func() (io.ReadCloser, error), body io.ReadCloser, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() (io.ReadCloser, error) {
+			return req.Body, nil
+		}, nil, nil
+	}
+
+	if req.GetBody != nil {
+		// the original body will not be used
+		req.Body.Close()
+		return req.GetBody, nil, nil
+	}
+
+	max := t.MaxBodyBuffer
+	if max == 0 {
+		max = DefaultMaxBodyBuffer
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, nil, err
+	}
+
+	if int64(len(buf)) > max {
+		// too big, let's rebuild the body with what has already been read
+		return nil, &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(buf), req.Body),
+			Closer: req.Body,
+		}, nil
+	}
+
+	req.Body.Close()
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}, nil, nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// drainAndClose reads what remains in a body so that its connection can be reused, then closes it
+func drainAndClose(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	io.CopyN(ioutil.Discard, body, maxDrainSize)
+	body.Close()
+}
@@ -0,0 +1,195 @@
+package retry
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fchoquet/golibs/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyServer returns a server failing with the passed status until the nth request
+// It echoes the request body and records every received body
+func newFlakyServer(status, n int) (*httptest.Server, func() []string) {
+	var mutex sync.Mutex
+	var bodies []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mutex.Lock()
+		bodies = append(bodies, string(body))
+		count := len(bodies)
+		mutex.Unlock()
+
+		if count < n {
+			w.WriteHeader(status)
+			w.Write([]byte("failed"))
+			return
+		}
+		w.Write(body)
+	}))
+
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, bodies...)
+	}
+}
+
+func TestTransportRetriesRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	server, bodies := newFlakyServer(503, 3)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &Transport{Retrier: New(3, TestBackoff)},
+	}
+
+	// GetBody is set by http.NewRequest for strings.Reader
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader("hello"))
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	assert.Equal(200, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal("hello", string(body))
+	assert.Equal([]string{"hello", "hello", "hello"}, bodies())
+}
+
+func TestTransportBuffersBodiesWithoutGetBody(t *testing.T) {
+	assert := assert.New(t)
+
+	server, bodies := newFlakyServer(503, 2)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &Transport{Retrier: New(3, TestBackoff)},
+	}
+
+	// a reader unknown to http.NewRequest
+	res, err := client.Post(server.URL, "text/plain", ioutil.NopCloser(strings.NewReader("hello")))
+	assert.NoError(err)
+	res.Body.Close()
+
+	assert.Equal(200, res.StatusCode)
+	assert.Equal([]string{"hello", "hello"}, bodies())
+}
+
+func TestTransportDoesNotRetryBodiesTooBigToBeBuffered(t *testing.T) {
+	assert := assert.New(t)
+
+	server, bodies := newFlakyServer(503, 2)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &Transport{Retrier: New(3, TestBackoff), MaxBodyBuffer: 3},
+	}
+
+	body := ioutil.NopCloser(strings.NewReader("hello"))
+	req, _ := http.NewRequest("POST", server.URL, body)
+	res, err := client.Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+
+	// the status is returned as is
+	assert.Equal(503, res.StatusCode)
+	// the body was sent entirely
+	assert.Equal([]string{"hello"}, bodies())
+	// the caller's request is left untouched
+	assert.Equal(body, req.Body)
+}
+
+func TestTransportReturnsTheLastResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	server, bodies := newFlakyServer(502, 10)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &Transport{Retrier: New(3, TestBackoff)},
+	}
+
+	res, err := client.Get(server.URL)
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	assert.Equal(502, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal("failed", string(body))
+	assert.Len(bodies(), 3)
+}
+
+func TestTransportStopsWhenTheContextIsCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	server, bodies := newFlakyServer(503, 10)
+	defer server.Close()
+
+	c := clock.NewFake(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	client := &http.Client{
+		Transport: &Transport{Retrier: New(3, Constant(time.Hour), WithClock(c))},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req = req.WithContext(ctx)
+
+	go func() {
+		// cancel while the retrier waits before the second attempt
+		c.BlockUntil(1)
+		cancel()
+	}()
+
+	_, err := client.Do(req)
+	assert.Error(err)
+	assert.True(strings.Contains(err.Error(), context.Canceled.Error()))
+	assert.Len(bodies(), 1)
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTransportClosesDiscardedResponses(t *testing.T) {
+	assert := assert.New(t)
+
+	var bodies []*closeRecorder
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body := &closeRecorder{Reader: strings.NewReader("unavailable")}
+		bodies = append(bodies, body)
+		return &http.Response{StatusCode: 503, Body: body}, nil
+	})
+
+	transport := &Transport{Retrier: New(3, TestBackoff), Base: base}
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, err := transport.RoundTrip(req)
+
+	assert.NoError(err)
+	assert.Equal(503, res.StatusCode)
+	assert.Len(bodies, 3)
+	assert.True(bodies[0].closed)
+	assert.True(bodies[1].closed)
+	// the caller closes the last one
+	assert.False(bodies[2].closed)
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}